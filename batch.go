@@ -0,0 +1,43 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// finds the instances of several network IPs or instance names, listing the
+// instances of every project or zone searched once for all of them. The hosts
+// not resolved get their error instead.
+func searchInstances(ctx context.Context, computeService *compute.Service, cfg *Config, hosts []string) (map[string]instanceMatch, map[string]error) {
+	found := map[string]instanceMatch{}
+	failed := map[string]error{}
+	scopes, err := searchScopes(ctx, computeService, cfg)
+	if err != nil {
+		for _, host := range hosts {
+			failed[host] = err
+		}
+		return found, failed
+	}
+
+	queries := make([]instanceQuery, len(hosts))
+	for i, host := range hosts {
+		queries[i] = withIAPTag(cfg, hostQuery(cfg, host))
+	}
+	// The names are matched on the listed instances, not filtered by the API
+	matches, errs := searchQueries(ctx, computeService, cfg, scopes, instanceFilter(cfg), queries)
+	for i, host := range hosts {
+		match, err := pickMatch(queries[i], matches[i], errs, len(scopes))
+		if err != nil {
+			failed[host] = err
+			continue
+		}
+		found[host] = match
+	}
+	return found, failed
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// resolutionCache stores the instances resolved from network IPs on disk so
+// the many ansible tasks run against the same host don't search the compute
+// API every time
+type resolutionCache struct {
+	path string
+	ttl  time.Duration
+	// scope prefixes the keys, jobs searching with other settings don't read
+	// each other resolutions
+	scope string
+}
+
+type cacheEntry struct {
+	Instance string `json:"instance"`
+	Zone     string `json:"zone"`
+	Project  string `json:"project"`
+	// Interface is the network interface with the IP of multi-NIC instances
+	Interface   string `json:"interface,omitempty"`
+	Preemptible bool   `json:"preemptible,omitempty"`
+	// ID is the numeric ID of the instance
+	ID string `json:"id,omitempty"`
+	// Zones are the zones of a region, its entries have nothing else
+	Zones []string `json:"zones,omitempty"`
+	// Account is the gcloud account, its entries have nothing else
+	Account string    `json:"account,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Creates a cache stored in dir for the searches of cfg, a nil cache is
+// returned when ttl disables it
+func newResolutionCache(dir string, ttl time.Duration, cfg *Config) *resolutionCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &resolutionCache{
+		path:  filepath.Join(dir, "gcloud-ssh-cache.json"),
+		ttl:   ttl,
+		scope: searchScopeKey(cfg),
+	}
+}
+
+// Hashes the settings changing which instance a host resolves to, with the
+// identity of the default credentials the instances are searched with. The
+// default project must already be in cfg.Projects.
+func searchScopeKey(cfg *Config) string {
+	data, _ := json.Marshal(struct {
+		Projects, Zones, Regions, AllowedProjects, StatusFilter []string
+		Zone, Project, Folder, HostProject, Network             string
+		LabelFilter, InstanceFilter, RequireIAPTag              string
+		CredentialsFile, ImpersonateSA, ComputeEndpoint         string
+		ProjectCredentials                                      map[string]string
+		MatchExternal                                           bool
+		Identity                                                []string
+	}{
+		cfg.Projects, cfg.Zones, cfg.Regions, cfg.AllowedProjects, cfg.StatusFilter,
+		cfg.Zone, cfg.Project, cfg.Folder, cfg.HostProject, cfg.Network,
+		cfg.LabelFilter, cfg.InstanceFilter, cfg.RequireIAPTag,
+		cfg.CredentialsFile, cfg.ImpersonateSA, cfg.ComputeEndpoint,
+		cfg.ProjectCredentials,
+		cfg.MatchExternal,
+		credentialsIdentity(),
+	})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Gets what the default credentials are found from: the credentials file of
+// GOOGLE_APPLICATION_CREDENTIALS, or the account and config gcloud logged in
+// the user home
+func credentialsIdentity() []string {
+	home, _ := os.UserHomeDir()
+	return []string{
+		os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"),
+		os.Getenv("CLOUDSDK_CORE_ACCOUNT"),
+		os.Getenv("CLOUDSDK_CONFIG"),
+		home,
+	}
+}
+
+// Locks the cache file against other wrapper processes, ansible runs many
+// forks at the same time. The cache directory is created on first use.
+func (c *resolutionCache) lock() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(c.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func (c *resolutionCache) load() (map[string]cacheEntry, error) {
+	entries := map[string]cacheEntry{}
+	info, err := os.Lstat(c.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Resolutions planted by another user would redirect the connections
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || int(stat.Uid) != os.Getuid() || !info.Mode().IsRegular() || info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("Not trusting the cache file, it must be a file only its owner, the current user, can access: %v", info.Mode())
+	}
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		// A corrupted cache is discarded
+		logger.Warnf("Ignoring invalid cache file %s: %v", c.path, err)
+		return map[string]cacheEntry{}, nil
+	}
+	return entries, nil
+}
+
+func (c *resolutionCache) save(entries map[string]cacheEntry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// Gets the instance resolved for networkIP if it hasn't expired yet
+func (c *resolutionCache) Get(networkIP string) (cacheEntry, bool) {
+	if c == nil {
+		return cacheEntry{}, false
+	}
+	unlock, err := c.lock()
+	if err != nil {
+		logger.Warnf("Cannot lock cache file %s: %v", c.path, err)
+		return cacheEntry{}, false
+	}
+	defer unlock()
+
+	entries, err := c.load()
+	if err != nil {
+		logger.Warnf("Cannot read cache file %s: %v", c.path, err)
+		return cacheEntry{}, false
+	}
+	entry, ok := entries[c.scope+"/"+networkIP]
+	if !ok || time.Since(entry.Time) > c.ttl {
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+// Stores the instance resolved for networkIP, dropping expired entries
+func (c *resolutionCache) Put(networkIP string, entry cacheEntry) {
+	c.update(func(entries map[string]cacheEntry) {
+		entry.Time = time.Now()
+		entries[c.scope+"/"+networkIP] = entry
+		for key, e := range entries {
+			if time.Since(e.Time) > c.ttl {
+				delete(entries, key)
+			}
+		}
+	})
+}
+
+// Gets the zones of region if they haven't expired yet
+func (c *resolutionCache) GetRegionZones(region string) ([]string, bool) {
+	entry, ok := c.Get("regions/" + region)
+	return entry.Zones, ok && len(entry.Zones) > 0
+}
+
+// Stores the zones of region, the ansible tasks then get them once
+func (c *resolutionCache) PutRegionZones(region string, zones []string) {
+	c.Put("regions/"+region, cacheEntry{Zones: zones})
+}
+
+// Removes the instance resolved for networkIP, for example when the
+// connection failed because the instance was recreated
+func (c *resolutionCache) Invalidate(networkIP string) {
+	c.update(func(entries map[string]cacheEntry) {
+		delete(entries, c.scope+"/"+networkIP)
+	})
+}
+
+// Caching is best effort, errors are only logged
+func (c *resolutionCache) update(change func(entries map[string]cacheEntry)) {
+	if c == nil {
+		return
+	}
+	unlock, err := c.lock()
+	if err != nil {
+		logger.Warnf("Cannot lock cache file %s: %v", c.path, err)
+		return
+	}
+	defer unlock()
+
+	entries, err := c.load()
+	if err != nil {
+		logger.Warnf("Cannot read cache file %s: %v", c.path, err)
+		return
+	}
+	change(entries)
+	if err := c.save(entries); err != nil {
+		logger.Warnf("Cannot write cache file %s: %v", c.path, err)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResolutionCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcloud-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := newResolutionCache(dir, time.Minute, &Config{})
+	if _, ok := cache.Get("172.16.0.11"); ok {
+		t.Fatal("empty cache must miss")
+	}
+
+	cache.Put("172.16.0.11", cacheEntry{Instance: "instance-1", Zone: "us-central1-a", Project: "project-1"})
+	entry, ok := cache.Get("172.16.0.11")
+	if !ok {
+		t.Fatal("cached entry expected")
+	}
+	if entry.Instance != "instance-1" || entry.Zone != "us-central1-a" || entry.Project != "project-1" {
+		t.Fatalf("unexpected entry: %#+v", entry)
+	}
+
+	cache.Invalidate("172.16.0.11")
+	if _, ok := cache.Get("172.16.0.11"); ok {
+		t.Fatal("invalidated entry must miss")
+	}
+
+	// Entries older than the TTL are expired
+	cache.Put("172.16.0.12", cacheEntry{Instance: "instance-2"})
+	expiredCache := newResolutionCache(dir, time.Nanosecond, &Config{})
+	time.Sleep(time.Millisecond)
+	if _, ok := expiredCache.Get("172.16.0.12"); ok {
+		t.Fatal("expired entry must miss")
+	}
+
+	// A disabled cache never hits
+	disabled := newResolutionCache(dir, 0, &Config{})
+	disabled.Put("172.16.0.13", cacheEntry{Instance: "instance-3"})
+	if _, ok := disabled.Get("172.16.0.13"); ok {
+		t.Fatal("disabled cache must miss")
+	}
+}
+
+func TestResolutionCacheScope(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcloud-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	prod := newResolutionCache(dir, time.Minute, &Config{Projects: []string{"project-1"}, Network: "prod"})
+	prod.Put("172.16.0.11", cacheEntry{Instance: "instance-1", Zone: "us-central1-a", Project: "project-1"})
+	// Jobs searching another network or project have their own entries
+	for _, cfg := range []*Config{
+		{Projects: []string{"project-1"}, Network: "staging"},
+		{Projects: []string{"project-2"}, Network: "prod"},
+	} {
+		if _, ok := newResolutionCache(dir, time.Minute, cfg).Get("172.16.0.11"); ok {
+			t.Fatalf("%+v: other job entry must miss", cfg)
+		}
+	}
+	same := newResolutionCache(dir, time.Minute, &Config{Projects: []string{"project-1"}, Network: "prod"})
+	if entry, ok := same.Get("172.16.0.11"); !ok || entry.Instance != "instance-1" {
+		t.Fatalf("unexpected entry: %#+v %v", entry, ok)
+	}
+
+	// Other default credentials have their own entries too
+	defer os.Unsetenv("GOOGLE_APPLICATION_CREDENTIALS")
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "/etc/gcloud-ssh/other.json")
+	if _, ok := newResolutionCache(dir, time.Minute, &Config{Projects: []string{"project-1"}, Network: "prod"}).Get("172.16.0.11"); ok {
+		t.Fatal("other credentials entry must miss")
+	}
+}
+
+func TestResolutionCacheUntrusted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcloud-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The cache directory is created private to the user
+	cache := newResolutionCache(filepath.Join(dir, "cache"), time.Minute, &Config{})
+	cache.Put("172.16.0.11", cacheEntry{Instance: "instance-1", Zone: "us-central1-a", Project: "project-1"})
+	if info, err := os.Stat(filepath.Join(dir, "cache")); err != nil || info.Mode().Perm() != 0700 {
+		t.Fatalf("private cache directory expected: %v %v", info, err)
+	}
+	if _, ok := cache.Get("172.16.0.11"); !ok {
+		t.Fatal("cached entry expected")
+	}
+	if tmps, _ := filepath.Glob(filepath.Join(dir, "cache", "*.tmp")); len(tmps) != 0 {
+		t.Fatalf("unexpected temp files: %v", tmps)
+	}
+
+	// A cache file other users can write may have been planted
+	if err := os.Chmod(cache.path, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Get("172.16.0.11"); ok {
+		t.Fatal("untrusted cache file must miss")
+	}
+}
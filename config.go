@@ -0,0 +1,422 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+	"gopkg.in/yaml.v2"
+)
+
+const defaultConfigPath = "/etc/gcloud-ssh.yaml"
+
+// Config holds the wrapper settings. They are read from a YAML config file and
+// each of them can be overridden with its environment variable.
+type Config struct {
+	// Projects and Zones to search the instances in, all the zones when empty
+	Projects []string `yaml:"projects"`
+	Zones    []string `yaml:"zones"`
+	// Zone and Project are the zone and project the operator already knows
+	// the instances are in, they are connected to without searching them
+	Zone    string `yaml:"zone"`
+	Project string `yaml:"project"`
+	// Regions are searched in all their zones, in addition to Zones
+	Regions []string `yaml:"regions"`
+	// Folder is the folder or organization whose child projects are searched
+	// in addition to Projects, like "folders/123" or "organizations/456"
+	Folder string `yaml:"folder"`
+	// AllowedProjects are the only projects instances can be searched in and
+	// connected to, any project when empty
+	AllowedProjects []string `yaml:"allowed_projects"`
+	// HostProject is the shared VPC host project the searched network IPs
+	// belong to, instances are still searched in Projects
+	HostProject string `yaml:"host_project"`
+	// MatchExternal also matches the external IPs of the instances
+	MatchExternal bool `yaml:"match_external"`
+	// Network is the name or self-link of the VPC network the searched IPs
+	// are on, any network when empty
+	Network string `yaml:"network"`
+	// SubnetPrefilter only searches the zones in the regions of the
+	// subnetworks containing the searched IP
+	SubnetPrefilter bool `yaml:"subnet_prefilter"`
+	// LabelFilter is a key=value label the instances searched must have, any
+	// instance when empty
+	LabelFilter string `yaml:"label_filter"`
+	// InstanceFilter is a compute API filter expression the instances
+	// searched must match too, any instance when empty
+	InstanceFilter string `yaml:"instance_filter"`
+	// StatusFilter is the statuses of the instances searched, ALL for any
+	StatusFilter []string `yaml:"status_filter"`
+	// CredentialsFile is the service account key or credentials file of the
+	// compute API lookup, the application default credentials when empty
+	CredentialsFile string `yaml:"credentials_file"`
+	// ProjectCredentials are the credentials files of the projects searched
+	// with their own identity instead of CredentialsFile, keyed by project
+	ProjectCredentials map[string]string `yaml:"project_credentials"`
+	// ImpersonateSA is the service account impersonated by the compute API
+	// lookup, the default credentials are used when empty
+	ImpersonateSA string `yaml:"impersonate_sa"`
+	// ComputeScope is the OAuth scope of the compute API lookup, read-only as
+	// instances are only listed
+	ComputeScope string `yaml:"compute_scope"`
+	// QuotaProject is the project the compute API quota and billing are
+	// attributed to, the credentials project when empty
+	QuotaProject string `yaml:"quota_project"`
+	// ComputeEndpoint is the compute API base URL, for example a Private
+	// Google Access restricted VIP, the public endpoint when empty
+	ComputeEndpoint string `yaml:"compute_endpoint"`
+	// DoSCP runs the wrapper as scp instead of ssh
+	DoSCP bool `yaml:"do_scp"`
+	// Timeout bounds the compute API lookup
+	Timeout time.Duration `yaml:"timeout"`
+	// GcloudPath is the gcloud binary to run
+	GcloudPath string `yaml:"gcloud_path"`
+	// GcloudConfig is the gcloud configuration used, the active one when empty
+	GcloudConfig string `yaml:"gcloud_config"`
+	// KeyFile is the ssh key gcloud uses, ~/.ssh/google_compute_engine when
+	// empty, and ForceKeyFileOverwrite lets gcloud regenerate it
+	KeyFile               string `yaml:"key_file"`
+	ForceKeyFileOverwrite bool   `yaml:"force_key_file_overwrite"`
+	// SkipKeyPropagation runs gcloud in plain mode, never writing the key
+	// in the instance or project metadata, it must already be there
+	SkipKeyPropagation bool `yaml:"skip_key_propagation"`
+	// ReresolveOnFail resolves a preemptible instance again when the
+	// connection to it fails, it may have been recreated
+	ReresolveOnFail bool `yaml:"reresolve_on_fail"`
+	// CommandTimeout bounds the gcloud ssh and scp runs, 0 doesn't
+	CommandTimeout time.Duration `yaml:"command_timeout"`
+	// SystemSSHPath and SystemSCPPath are the original ssh and scp binaries,
+	// used when gcloud can't be
+	SystemSSHPath string `yaml:"system_ssh_path"`
+	SystemSCPPath string `yaml:"system_scp_path"`
+	// ExtraArgs are added to the gcloud compute ssh and scp flags
+	ExtraArgs []string `yaml:"extra_args"`
+	// PostHook is the executable run after the gcloud ssh and scp runs with
+	// their result in GCLOUD_SSH_RESULT_* variables, none when empty
+	PostHook string `yaml:"post_hook"`
+	// StripControl drops the ControlMaster, ControlPath and ControlPersist
+	// options of ansible instead of forwarding them to ssh
+	StripControl bool `yaml:"strip_control"`
+	// SSHTemplate and SCPTemplate replace the built-in gcloud arguments of
+	// ssh and scp when not empty, see templateData for their placeholders
+	SSHTemplate string `yaml:"ssh_template"`
+	SCPTemplate string `yaml:"scp_template"`
+	// OSLogin leaves the login user to gcloud, the OS Login username of its
+	// active account
+	OSLogin bool `yaml:"os_login"`
+	// Quiet runs gcloud with --quiet, without its prompts
+	Quiet bool `yaml:"quiet"`
+	// UseIAP connects through an IAP tunnel
+	UseIAP bool `yaml:"use_iap"`
+	// InternalIP connects directly to the internal IP instead of the external
+	// one, without IAP
+	InternalIP bool `yaml:"internal_ip"`
+	// RequireIAPTag is the network tag the instances reachable through IAP
+	// have, only they are matched when set
+	RequireIAPTag string `yaml:"require_iap_tag"`
+	// AutoStart starts the stopped instances found and waits up to
+	// AutoStartTimeout for them to run
+	AutoStart        bool          `yaml:"auto_start"`
+	AutoStartTimeout time.Duration `yaml:"auto_start_timeout"`
+	// BootWait is the time waited for an instance found PROVISIONING or
+	// STAGING to run, 0 doesn't wait
+	BootWait time.Duration `yaml:"boot_wait"`
+
+	// LogFile is the log file path, logs go to stderr when empty
+	LogFile string `yaml:"log_file"`
+	// LogMaxBytes is the size the log file is rotated at, 0 disables it, and
+	// LogMaxFiles the number of rotated files kept
+	LogMaxBytes int `yaml:"log_max_bytes"`
+	LogMaxFiles int `yaml:"log_max_files"`
+	// LogFormat is "text" or "json", LogLevel is the minimum level logged
+	LogFormat string `yaml:"log_format"`
+	LogLevel  string `yaml:"log_level"`
+	// LogTiming logs the time taken by each phase of the resolution and the
+	// gcloud runs
+	LogTiming bool `yaml:"log_timing"`
+	// RedactKeys are ssh option keys whose values are not logged, in addition
+	// to User and the password, token and secret ones
+	RedactKeys []string `yaml:"redact_keys"`
+
+	MaxRetries     int           `yaml:"max_retries"`
+	Concurrency    int           `yaml:"concurrency"`
+	CacheDir       string        `yaml:"cache_dir"`
+	CacheTTL       time.Duration `yaml:"cache_ttl"`
+	FallbackDirect bool          `yaml:"fallback_direct"`
+	// MaxScan is the number of instances a project or zone search lists
+	// without a match before failing, no limit when 0
+	MaxScan int `yaml:"max_scan"`
+	// Socket is the unix socket of the resolver daemon asked before searching
+	// the compute API, none when empty
+	Socket string `yaml:"socket"`
+	// StatsdAddr is the statsd host:port metrics are sent to, none when empty
+	StatsdAddr string `yaml:"statsd_addr"`
+
+	// readOnly finds the instances without starting them or waiting for
+	// their boot, like the resolve subcommand
+	readOnly bool
+	// refresh resolves the hosts again, ignoring the daemon resolutions in
+	// memory, after the instance couldn't be connected to
+	refresh bool
+}
+
+func defaultConfig() Config {
+	return Config{
+		Timeout:          30 * time.Second,
+		ComputeScope:     compute.ComputeReadonlyScope,
+		StatusFilter:     []string{"RUNNING", "PROVISIONING", "STAGING"},
+		GcloudPath:       "gcloud",
+		SystemSSHPath:    "system-ssh",
+		SystemSCPPath:    "system-scp",
+		Quiet:            true,
+		ReresolveOnFail:  true,
+		MatchExternal:    true,
+		UseIAP:           true,
+		AutoStartTimeout: 5 * time.Minute,
+		LogFile:          "/var/log/gcloud-ssh.log",
+		LogMaxBytes:      10 * 1024 * 1024,
+		LogMaxFiles:      5,
+		LogFormat:        "text",
+		LogLevel:         "debug",
+		MaxRetries:       4,
+		MaxScan:          5000,
+		Concurrency:      8,
+		CacheDir:         defaultCacheDir(),
+		CacheTTL:         300 * time.Second,
+	}
+}
+
+// Gets the per-user cache directory, other users can't plant resolutions in
+// it like in the shared temp dir
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), fmt.Sprintf("gcloud-ssh-%d", os.Getuid()))
+	}
+	return filepath.Join(dir, "gcloud-ssh")
+}
+
+// Loads the config file, silently ignored when missing, and overrides its
+// values with the environment variables
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return cfg, err
+	}
+	if err == nil {
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("Invalid config file %s: %w", path, err)
+		}
+	}
+
+	err = cfg.applyEnv()
+	return cfg, err
+}
+
+func (cfg *Config) applyEnv() error {
+	var err error
+	cfg.Projects = getEnvList("GCLOUD_SSH_PROJECTS", cfg.Projects)
+	cfg.Zones = getEnvList("GCLOUD_SSH_ZONES", cfg.Zones)
+	cfg.Regions = getEnvList("GCLOUD_SSH_REGIONS", cfg.Regions)
+	cfg.Zone = getEnv("GCLOUD_SSH_ZONE", cfg.Zone)
+	cfg.Project = getEnv("GCLOUD_SSH_PROJECT", cfg.Project)
+	if (cfg.Zone == "") != (cfg.Project == "") {
+		return fmt.Errorf("GCLOUD_SSH_ZONE and GCLOUD_SSH_PROJECT must be set together")
+	}
+	cfg.Folder = getEnv("GCLOUD_SSH_FOLDER", cfg.Folder)
+	if _, err := folderParent(cfg.Folder); err != nil {
+		return err
+	}
+	cfg.AllowedProjects = getEnvList("GCLOUD_SSH_ALLOWED_PROJECTS", cfg.AllowedProjects)
+	cfg.StatusFilter = getEnvList("GCLOUD_SSH_STATUS_FILTER", cfg.StatusFilter)
+	cfg.Network = getEnv("GCLOUD_SSH_NETWORK", cfg.Network)
+	cfg.LabelFilter = getEnv("GCLOUD_SSH_LABEL_FILTER", cfg.LabelFilter)
+	if _, err := labelFilter(cfg.LabelFilter); err != nil {
+		return err
+	}
+	if filter, ok := os.LookupEnv("GCLOUD_SSH_INSTANCE_FILTER"); ok {
+		if strings.TrimSpace(filter) == "" {
+			return fmt.Errorf("Empty GCLOUD_SSH_INSTANCE_FILTER, unset it to search any instance")
+		}
+		cfg.InstanceFilter = filter
+	}
+	if _, err := expressionFilter(cfg.InstanceFilter); err != nil {
+		return err
+	}
+	cfg.HostProject = getEnv("GCLOUD_SSH_HOST_PROJECT", cfg.HostProject)
+	cfg.CredentialsFile = getEnv("GCLOUD_SSH_CREDENTIALS_FILE", cfg.CredentialsFile)
+	if _, ok := os.LookupEnv("GCLOUD_SSH_PROJECT_CREDENTIALS"); ok {
+		if cfg.ProjectCredentials, err = parseProjectCredentials(getEnvList("GCLOUD_SSH_PROJECT_CREDENTIALS", nil)); err != nil {
+			return err
+		}
+	}
+	cfg.ImpersonateSA = getEnv("GCLOUD_SSH_IMPERSONATE_SA", cfg.ImpersonateSA)
+	cfg.ComputeScope = getEnv("GCLOUD_SSH_COMPUTE_SCOPE", cfg.ComputeScope)
+	cfg.QuotaProject = getEnv("GCLOUD_SSH_QUOTA_PROJECT", cfg.QuotaProject)
+	cfg.ComputeEndpoint = getEnv("GCLOUD_SSH_COMPUTE_ENDPOINT", cfg.ComputeEndpoint)
+	cfg.GcloudPath = getEnv("GCLOUD_SSH_GCLOUD_BIN", cfg.GcloudPath)
+	cfg.GcloudConfig = getEnv("GCLOUD_SSH_GCLOUD_CONFIG", cfg.GcloudConfig)
+	cfg.SystemSSHPath = getEnv("GCLOUD_SSH_SYSTEM_SSH", cfg.SystemSSHPath)
+	cfg.SystemSCPPath = getEnv("GCLOUD_SSH_SYSTEM_SCP", cfg.SystemSCPPath)
+	cfg.RequireIAPTag = getEnv("GCLOUD_SSH_REQUIRE_IAP_TAG", cfg.RequireIAPTag)
+	cfg.Socket = getEnv("GCLOUD_SSH_SOCKET", cfg.Socket)
+	cfg.CacheDir = getEnv("GCLOUD_SSH_CACHE_DIR", cfg.CacheDir)
+	cfg.StatsdAddr = getEnv("GCLOUD_SSH_STATSD_ADDR", cfg.StatsdAddr)
+	cfg.KeyFile = getEnv("GCLOUD_SSH_KEY_FILE", cfg.KeyFile)
+	cfg.LogFile = getEnv("GCLOUD_SSH_LOG_FILE", cfg.LogFile)
+	cfg.LogFormat = getEnv("GCLOUD_SSH_LOG_FORMAT", cfg.LogFormat)
+	cfg.LogLevel = getEnv("GCLOUD_SSH_LOG_LEVEL", cfg.LogLevel)
+	cfg.RedactKeys = getEnvList("GCLOUD_SSH_REDACT_KEYS", cfg.RedactKeys)
+	if cfg.ExtraArgs, err = getEnvArgs("GCLOUD_SSH_EXTRA_ARGS", cfg.ExtraArgs); err != nil {
+		return err
+	}
+	cfg.PostHook = getEnv("GCLOUD_SSH_POST_HOOK", cfg.PostHook)
+	cfg.SSHTemplate = getEnv("GCLOUD_SSH_SSH_TEMPLATE", cfg.SSHTemplate)
+	if err := validateTemplate("GCLOUD_SSH_SSH_TEMPLATE", cfg.SSHTemplate); err != nil {
+		return err
+	}
+	cfg.SCPTemplate = getEnv("GCLOUD_SSH_SCP_TEMPLATE", cfg.SCPTemplate)
+	if err := validateTemplate("GCLOUD_SSH_SCP_TEMPLATE", cfg.SCPTemplate); err != nil {
+		return err
+	}
+	if cfg.StripControl, err = getEnvBool("GCLOUD_SSH_STRIP_CONTROL", cfg.StripControl); err != nil {
+		return err
+	}
+	if cfg.LogTiming, err = getEnvBool("GCLOUD_SSH_LOG_TIMING", cfg.LogTiming); err != nil {
+		return err
+	}
+	if cfg.DoSCP, err = getEnvBool("DO_SCP", cfg.DoSCP); err != nil {
+		return err
+	}
+	if cfg.Quiet, err = getEnvBool("GCLOUD_SSH_QUIET", cfg.Quiet); err != nil {
+		return err
+	}
+	if cfg.UseIAP, err = getEnvBool("GCLOUD_SSH_USE_IAP", cfg.UseIAP); err != nil {
+		return err
+	}
+	if cfg.InternalIP, err = getEnvBool("GCLOUD_SSH_INTERNAL_IP", cfg.InternalIP); err != nil {
+		return err
+	}
+	if cfg.InternalIP && cfg.UseIAP {
+		// gcloud refuses --internal-ip with --tunnel-through-iap
+		return fmt.Errorf("GCLOUD_SSH_INTERNAL_IP connects without IAP, set GCLOUD_SSH_USE_IAP=false to use it")
+	}
+	if cfg.OSLogin, err = getEnvBool("GCLOUD_SSH_OS_LOGIN", cfg.OSLogin); err != nil {
+		return err
+	}
+	if cfg.MatchExternal, err = getEnvBool("GCLOUD_SSH_MATCH_EXTERNAL", cfg.MatchExternal); err != nil {
+		return err
+	}
+	if cfg.SubnetPrefilter, err = getEnvBool("GCLOUD_SSH_SUBNET_PREFILTER", cfg.SubnetPrefilter); err != nil {
+		return err
+	}
+	if cfg.AutoStart, err = getEnvBool("GCLOUD_SSH_AUTO_START", cfg.AutoStart); err != nil {
+		return err
+	}
+	if cfg.AutoStartTimeout, err = getEnvDuration("GCLOUD_SSH_AUTO_START_TIMEOUT", cfg.AutoStartTimeout); err != nil {
+		return err
+	}
+	if cfg.BootWait, err = getEnvDuration("GCLOUD_SSH_BOOT_WAIT", cfg.BootWait); err != nil {
+		return err
+	}
+	if cfg.FallbackDirect, err = getEnvBool("GCLOUD_SSH_FALLBACK_DIRECT", cfg.FallbackDirect); err != nil {
+		return err
+	}
+	if cfg.Timeout, err = getEnvDuration("GCLOUD_SSH_API_TIMEOUT", cfg.Timeout); err != nil {
+		return err
+	}
+	if cfg.ForceKeyFileOverwrite, err = getEnvBool("GCLOUD_SSH_FORCE_KEY_FILE_OVERWRITE", cfg.ForceKeyFileOverwrite); err != nil {
+		return err
+	}
+	if cfg.SkipKeyPropagation, err = getEnvBool("GCLOUD_SSH_SKIP_KEY_PROPAGATION", cfg.SkipKeyPropagation); err != nil {
+		return err
+	}
+	if cfg.ReresolveOnFail, err = getEnvBool("GCLOUD_SSH_RERESOLVE_ON_FAIL", cfg.ReresolveOnFail); err != nil {
+		return err
+	}
+	if cfg.CommandTimeout, err = getEnvDuration("GCLOUD_SSH_COMMAND_TIMEOUT", cfg.CommandTimeout); err != nil {
+		return err
+	}
+	if cfg.CacheTTL, err = getEnvDuration("GCLOUD_SSH_CACHE_TTL", cfg.CacheTTL); err != nil {
+		return err
+	}
+	if cfg.LogMaxBytes, err = getEnvInt("GCLOUD_SSH_LOG_MAX_BYTES", cfg.LogMaxBytes); err != nil {
+		return err
+	}
+	if cfg.LogMaxFiles, err = getEnvInt("GCLOUD_SSH_LOG_MAX_FILES", cfg.LogMaxFiles); err != nil {
+		return err
+	}
+	if cfg.MaxRetries, err = getEnvInt("GCLOUD_SSH_MAX_RETRIES", cfg.MaxRetries); err != nil {
+		return err
+	}
+	if cfg.MaxScan, err = getEnvInt("GCLOUD_SSH_MAX_SCAN", cfg.MaxScan); err != nil {
+		return err
+	}
+	if cfg.Concurrency, err = getEnvInt("GCLOUD_SSH_CONCURRENCY", cfg.Concurrency); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get env var split into space or comma separated arguments or default
+func getEnvArgs(key string, fallback []string) ([]string, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+	args, err := splitCommandLine(value, " \t,")
+	if err != nil {
+		return fallback, fmt.Errorf("Invalid %s: %w", key, err)
+	}
+	return args, nil
+}
+
+// Get bool env var or default
+func getEnvBool(key string, fallback bool) (bool, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return fallback, fmt.Errorf("Invalid %s: %w", key, err)
+	}
+	return b, nil
+}
+
+// Get int env var or default
+func getEnvInt(key string, fallback int) (int, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return fallback, fmt.Errorf("Invalid %s: %w", key, err)
+	}
+	return i, nil
+}
+
+// Get duration env var or default
+func getEnvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fallback, fmt.Errorf("Invalid %s: %w", key, err)
+	}
+	return d, nil
+}
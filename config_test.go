@@ -0,0 +1,110 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcloud-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A missing file keeps the defaults
+	path := filepath.Join(dir, "gcloud-ssh.yaml")
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, defaultConfig()) {
+		t.Fatalf("'%#+v' != '%#+v'", cfg, defaultConfig())
+	}
+
+	err = ioutil.WriteFile(path, []byte(`
+projects: [project-1, project-2]
+zones: [us-central1-a]
+do_scp: true
+timeout: 10s
+gcloud_path: /usr/lib/google-cloud-sdk/bin/gcloud
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file overrides the defaults
+	cfg, err = loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.Projects, []string{"project-1", "project-2"}) {
+		t.Fatalf("unexpected projects: %v", cfg.Projects)
+	}
+	if !reflect.DeepEqual(cfg.Zones, []string{"us-central1-a"}) {
+		t.Fatalf("unexpected zones: %v", cfg.Zones)
+	}
+	if !cfg.DoSCP || cfg.Timeout != 10*time.Second || cfg.GcloudPath != "/usr/lib/google-cloud-sdk/bin/gcloud" {
+		t.Fatalf("unexpected config: %#+v", cfg)
+	}
+	if cfg.MaxRetries != 4 {
+		t.Fatalf("'%v' != '%v'", cfg.MaxRetries, 4)
+	}
+	// External IPs are matched unless disabled
+	if !cfg.MatchExternal {
+		t.Fatalf("'%v' != '%v'", cfg.MatchExternal, true)
+	}
+
+	// The env vars override the file
+	os.Setenv("GCLOUD_SSH_PROJECTS", "project-3")
+	os.Setenv("DO_SCP", "false")
+	os.Setenv("GCLOUD_SSH_API_TIMEOUT", "1m")
+	defer os.Unsetenv("GCLOUD_SSH_PROJECTS")
+	defer os.Unsetenv("DO_SCP")
+	defer os.Unsetenv("GCLOUD_SSH_API_TIMEOUT")
+	cfg, err = loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.Projects, []string{"project-3"}) {
+		t.Fatalf("unexpected projects: %v", cfg.Projects)
+	}
+	if !reflect.DeepEqual(cfg.Zones, []string{"us-central1-a"}) {
+		t.Fatalf("unexpected zones: %v", cfg.Zones)
+	}
+	if cfg.DoSCP || cfg.Timeout != time.Minute {
+		t.Fatalf("unexpected config: %#+v", cfg)
+	}
+
+	os.Setenv("GCLOUD_SSH_API_TIMEOUT", "forever")
+	if _, err := loadConfig(path); err == nil {
+		t.Fatal("invalid timeout error expected")
+	}
+}
+
+func TestGetEnvList(t *testing.T) {
+	defer os.Unsetenv("GCLOUD_SSH_PROJECTS")
+	fallback := []string{"project-0"}
+	for value, expected := range map[string][]string{
+		"project-1":              {"project-1"},
+		"project-1,":             {"project-1"},
+		" project-1, project-2 ": {"project-1", "project-2"},
+		"project-1,,project-2,":  {"project-1", "project-2"},
+		" , ":                    fallback,
+		"":                       fallback,
+	} {
+		os.Setenv("GCLOUD_SSH_PROJECTS", value)
+		if projects := getEnvList("GCLOUD_SSH_PROJECTS", fallback); !reflect.DeepEqual(projects, expected) {
+			t.Fatalf("%q: '%v' != '%v'", value, projects, expected)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+var (
+	// projectComputeServices are the compute API clients of the projects with
+	// their own credentials, created on first use
+	projectComputeServicesMu sync.Mutex
+	projectComputeServices   = map[string]*compute.Service{}
+)
+
+// Parses the project=path pairs of the credentials files of the projects
+func parseProjectCredentials(pairs []string) (map[string]string, error) {
+	credentials := map[string]string{}
+	for _, pair := range pairs {
+		i := strings.Index(pair, "=")
+		if i <= 0 || strings.TrimSpace(pair[i+1:]) == "" {
+			return nil, fmt.Errorf("Invalid project credentials %q, expected project=path", pair)
+		}
+		credentials[strings.TrimSpace(pair[:i])] = strings.TrimSpace(pair[i+1:])
+	}
+	return credentials, nil
+}
+
+// Gets the compute API client searching project, the one with its credentials
+// file in cfg.ProjectCredentials or computeService for the other projects
+func projectComputeService(cfg *Config, computeService *compute.Service, project string) (*compute.Service, error) {
+	credentialsFile, ok := cfg.ProjectCredentials[project]
+	if !ok {
+		return computeService, nil
+	}
+	projectComputeServicesMu.Lock()
+	defer projectComputeServicesMu.Unlock()
+	if service, ok := projectComputeServices[project]; ok {
+		return service, nil
+	}
+
+	scoped := *cfg
+	scoped.CredentialsFile = credentialsFile
+	// The client outlives the deadline of the lookup creating it
+	service, err := buildComputeService(context.Background(), &scoped)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create the compute API client of project %s: %w", project, err)
+	}
+	projectComputeServices[project] = service
+	return service, nil
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestProjectCredentials(t *testing.T) {
+	var mu sync.Mutex
+	var builds []string
+	// Every client only sees the project of its credentials
+	serviceFor := func(project string) *compute.Service {
+		return newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+			if !strings.Contains(req.URL.Path, "/projects/"+project+"/") {
+				return jsonResponse(http.StatusForbidden, `{"error": {"code": 403, "message": "Forbidden"}}`), nil
+			}
+			if project != "project-2" {
+				return jsonResponse(http.StatusOK, `{}`), nil
+			}
+			return jsonResponse(http.StatusOK, aggregatedListResponse), nil
+		})
+	}
+	stubBuildComputeService(t, func(ctx context.Context, cfg *Config) (*compute.Service, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		builds = append(builds, cfg.CredentialsFile)
+		return serviceFor(strings.TrimSuffix(strings.TrimPrefix(cfg.CredentialsFile, "/etc/gcloud-ssh/"), ".json")), nil
+	})
+
+	cfg := &Config{
+		Projects:           []string{"project-1", "project-2"},
+		ProjectCredentials: map[string]string{"project-2": "/etc/gcloud-ssh/project-2.json"},
+		MaxRetries:         4,
+		Concurrency:        2,
+	}
+	computeService := serviceFor("project-1")
+	for i := 0; i < 2; i++ {
+		_, _, project, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if project != "project-2" {
+			t.Fatalf("'%v' != '%v'", project, "project-2")
+		}
+	}
+	// The project client is created once with its own credentials
+	if !reflect.DeepEqual(builds, []string{"/etc/gcloud-ssh/project-2.json"}) {
+		t.Fatalf("unexpected clients: %v", builds)
+	}
+}
+
+func TestParseProjectCredentials(t *testing.T) {
+	defer os.Unsetenv("GCLOUD_SSH_PROJECT_CREDENTIALS")
+	os.Setenv("GCLOUD_SSH_PROJECT_CREDENTIALS", "project-1=/etc/gcloud-ssh/project-1.json, project-2 = /etc/gcloud-ssh/project-2.json")
+	cfg := defaultConfig()
+	if err := cfg.applyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"project-1": "/etc/gcloud-ssh/project-1.json", "project-2": "/etc/gcloud-ssh/project-2.json"}
+	if !reflect.DeepEqual(cfg.ProjectCredentials, expected) {
+		t.Fatalf("'%v' != '%v'", cfg.ProjectCredentials, expected)
+	}
+
+	for _, pairs := range []string{"project-1", "=/etc/gcloud-ssh/project-1.json", "project-1="} {
+		os.Setenv("GCLOUD_SSH_PROJECT_CREDENTIALS", pairs)
+		cfg := defaultConfig()
+		if err := cfg.applyEnv(); err == nil {
+			t.Fatalf("%v: invalid project credentials error expected", pairs)
+		}
+	}
+}
+
+func TestProjectCredentialsSubcommands(t *testing.T) {
+	// Every client only sees the project of its credentials
+	serviceFor := func(project string) *compute.Service {
+		return newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+			if !strings.Contains(req.URL.Path, "/projects/"+project+"/") {
+				return jsonResponse(http.StatusForbidden, `{"error": {"code": 403, "message": "Forbidden"}}`), nil
+			}
+			if project == "project-2" && strings.HasSuffix(req.URL.Path, "/aggregated/instances") {
+				return jsonResponse(http.StatusOK, aggregatedListResponse), nil
+			}
+			return jsonResponse(http.StatusOK, `{}`), nil
+		})
+	}
+	stubBuildComputeService(t, func(ctx context.Context, cfg *Config) (*compute.Service, error) {
+		return serviceFor(strings.TrimSuffix(strings.TrimPrefix(cfg.CredentialsFile, "/etc/gcloud-ssh/"), ".json")), nil
+	})
+
+	cfg := &Config{
+		Projects:           []string{"project-1", "project-2"},
+		ProjectCredentials: map[string]string{"project-2": "/etc/gcloud-ssh/project-2.json"},
+		MaxRetries:         4,
+		Concurrency:        2,
+	}
+	computeService := serviceFor("project-1")
+	result, err := buildInventory(context.Background(), cfg, computeService, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostvars := result["_meta"].(map[string]interface{})["hostvars"].(map[string]inventoryHost); hostvars["172.16.0.11"].Project != "project-2" {
+		t.Fatalf("unexpected inventory: %v", hostvars)
+	}
+
+	var out bytes.Buffer
+	if !runHealthcheck(context.Background(), cfg, computeService, []string{"172.16.0.11"}, &out) {
+		t.Fatalf("healthy checks expected:\n%s", out.String())
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// errorDaemonUnavailable is returned when no resolver daemon answers on the
+// socket, the lookup is then done by the wrapper itself
+var errorDaemonUnavailable = errors.New("Resolver daemon unavailable")
+
+// resolveRequest and resolveResponse are the resolver daemon protocol, a JSON
+// request line answered with a JSON response line
+type resolveRequest struct {
+	Host string `json:"host"`
+	// Refresh looks host up again instead of answering from memory
+	Refresh bool `json:"refresh,omitempty"`
+}
+
+type resolveResponse struct {
+	Instance    string `json:"instance,omitempty"`
+	Zone        string `json:"zone,omitempty"`
+	Project     string `json:"project,omitempty"`
+	Interface   string `json:"interface,omitempty"`
+	Preemptible bool   `json:"preemptible,omitempty"`
+	ID          string `json:"id,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// NotFound is set when the error is an ErrInstanceNotFound one
+	NotFound bool `json:"not_found,omitempty"`
+}
+
+// daemonError is an error returned by the resolver daemon
+type daemonError struct {
+	message  string
+	notFound bool
+}
+
+func (e *daemonError) Error() string {
+	return e.message
+}
+
+func (e *daemonError) Is(target error) bool {
+	return e.notFound && target == ErrInstanceNotFound
+}
+
+// checks if the wrapper is asked to run the resolver daemon, ansible never
+// passes a serve first argument
+func isServeRequest(args []string) bool {
+	return len(args) > 1 && args[1] == "serve"
+}
+
+// resolverDaemon resolves hosts for the wrapper processes keeping the compute
+// API client and the resolved instances in memory
+type resolverDaemon struct {
+	ttl time.Duration
+	// timeout bounds the reading of a request and the writing of its
+	// response, so silent clients don't keep their connection open
+	timeout time.Duration
+	lookup  func(host string) (cacheEntry, error)
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func newResolverDaemon(cfg *Config) *resolverDaemon {
+	// The daemon searches the compute API itself, not through its own socket
+	daemonCfg := *cfg
+	daemonCfg.Socket = ""
+	return &resolverDaemon{
+		ttl:     cfg.CacheTTL,
+		timeout: cfg.Timeout,
+		lookup: func(host string) (cacheEntry, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), daemonCfg.Timeout)
+			defer cancel()
+			return lookupInstance(ctx, &daemonCfg, nil, host)
+		},
+		entries: map[string]cacheEntry{},
+	}
+}
+
+// Serves the resolutions on the unix socket until interrupted
+func serve(cfg *Config) error {
+	if cfg.Socket == "" {
+		return fmt.Errorf("Empty socket, set GCLOUD_SSH_SOCKET")
+	}
+	listener, err := listenSocket(cfg.Socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(cfg.Socket)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Infof("Stopping resolver daemon on %v", sig)
+		listener.Close()
+	}()
+
+	logger.Infof("Serving resolutions on %s", cfg.Socket)
+	newResolverDaemon(cfg).serve(listener)
+	return nil
+}
+
+// Listens on the unix socket, only the user running the daemon can connect to
+// it as the resolutions are searched with its credentials
+func listenSocket(socket string) (net.Listener, error) {
+	// A socket left by a daemon that didn't stop cleanly
+	os.Remove(socket)
+	// The socket is never accessible to other users, even before its chmod
+	umask := syscall.Umask(0077)
+	listener, err := net.Listen("unix", socket)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Serves the connections of listener until it is closed
+func (d *resolverDaemon) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go d.handle(conn)
+	}
+}
+
+func (d *resolverDaemon) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(d.timeout))
+	var request resolveRequest
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&request); err != nil {
+		logger.Warnf("Invalid resolver request: %v", err)
+		return
+	}
+
+	response := resolveResponse{}
+	entry, err := d.resolve(request.Host, request.Refresh)
+	if err != nil {
+		response.Error = err.Error()
+		response.NotFound = errors.Is(err, ErrInstanceNotFound)
+	} else {
+		response.Instance, response.Zone, response.Project = entry.Instance, entry.Zone, entry.Project
+		response.Interface, response.Preemptible, response.ID = entry.Interface, entry.Preemptible, entry.ID
+	}
+	// The lookup may have taken up to the timeout
+	conn.SetDeadline(time.Now().Add(d.timeout))
+	json.NewEncoder(conn).Encode(response)
+}
+
+// Resolves host from memory or with a lookup when missing, expired or
+// refreshed
+func (d *resolverDaemon) resolve(host string, refresh bool) (cacheEntry, error) {
+	d.mu.Lock()
+	entry, ok := d.entries[host]
+	d.mu.Unlock()
+	if ok && !refresh && time.Since(entry.Time) <= d.ttl {
+		return entry, nil
+	}
+
+	entry, err := d.lookup(host)
+	if err != nil {
+		return entry, err
+	}
+	entry.Time = time.Now()
+	d.mu.Lock()
+	d.entries[host] = entry
+	d.mu.Unlock()
+	return entry, nil
+}
+
+// Asks the resolver daemon listening on socket to resolve the request host,
+// failing with errorDaemonUnavailable when it can't be reached. Only a daemon
+// of the same user is trusted, another user could answer other instances.
+func resolveWithDaemon(socket string, request resolveRequest, timeout time.Duration) (cacheEntry, error) {
+	if err := checkSocketOwner(socket); err != nil {
+		return cacheEntry{}, fmt.Errorf("%w: %v", errorDaemonUnavailable, err)
+	}
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err != nil {
+		return cacheEntry{}, fmt.Errorf("%w: %v", errorDaemonUnavailable, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return cacheEntry{}, fmt.Errorf("%w: %v", errorDaemonUnavailable, err)
+	}
+	var response resolveResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return cacheEntry{}, fmt.Errorf("%w: %v", errorDaemonUnavailable, err)
+	}
+	if response.Error != "" {
+		return cacheEntry{}, &daemonError{message: response.Error, notFound: response.NotFound}
+	}
+	return cacheEntry{Instance: response.Instance, Zone: response.Zone, Project: response.Project, Interface: response.Interface, Preemptible: response.Preemptible, ID: response.ID}, nil
+}
+
+// checks that the socket is a unix socket of the current user
+func checkSocketOwner(socket string) error {
+	info, err := os.Lstat(socket)
+	if err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || int(stat.Uid) != os.Getuid() || info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("Not trusting %s, it must be a socket of the current user", socket)
+	}
+	return nil
+}
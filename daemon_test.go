@@ -0,0 +1,122 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResolverDaemon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcloud-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "gcloud-ssh.sock")
+
+	if _, err := resolveWithDaemon(socket, resolveRequest{Host: "172.16.0.11"}, time.Second); !errors.Is(err, errorDaemonUnavailable) {
+		t.Fatalf("unavailable daemon error expected, found '%v'", err)
+	}
+
+	// Only a socket is trusted
+	if err := ioutil.WriteFile(socket, []byte(`{"instance": "instance-2"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolveWithDaemon(socket, resolveRequest{Host: "172.16.0.11"}, time.Second); !errors.Is(err, errorDaemonUnavailable) {
+		t.Fatalf("unavailable daemon error expected, found '%v'", err)
+	}
+
+	listener, err := listenSocket(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// Other users can't resolve through the daemon
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("private socket expected: %v %v", info, err)
+	}
+	var lookups int32
+	daemon := &resolverDaemon{
+		ttl:     time.Minute,
+		timeout: time.Second,
+		lookup: func(host string) (cacheEntry, error) {
+			atomic.AddInt32(&lookups, 1)
+			if host != "172.16.0.11" {
+				return cacheEntry{}, &NotFoundError{Query: "networkIP: " + host}
+			}
+			return cacheEntry{Instance: "instance-1", Zone: "us-central1-a", Project: "project-1"}, nil
+		},
+		entries: map[string]cacheEntry{},
+	}
+	go daemon.serve(listener)
+
+	for i := 0; i < 2; i++ {
+		entry, err := resolveWithDaemon(socket, resolveRequest{Host: "172.16.0.11"}, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Instance != "instance-1" || entry.Zone != "us-central1-a" || entry.Project != "project-1" {
+			t.Fatalf("unexpected entry: %#+v", entry)
+		}
+	}
+	if lookups != 1 {
+		t.Fatalf("'%v' != '%v'", lookups, 1)
+	}
+	// Refreshed resolutions are looked up again
+	if _, err := resolveWithDaemon(socket, resolveRequest{Host: "172.16.0.11", Refresh: true}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if lookups != 2 {
+		t.Fatalf("'%v' != '%v'", lookups, 2)
+	}
+
+	_, err = resolveWithDaemon(socket, resolveRequest{Host: "172.16.0.12"}, time.Second)
+	if !errors.Is(err, ErrInstanceNotFound) || errors.Is(err, errorDaemonUnavailable) || err.Error() != "Not found networkIP: 172.16.0.12" {
+		t.Fatalf("not found error expected, found '%v'", err)
+	}
+}
+
+func TestResolverDaemonSilentClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcloud-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "gcloud-ssh.sock")
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	daemon := &resolverDaemon{
+		timeout: 50 * time.Millisecond,
+		lookup: func(host string) (cacheEntry, error) {
+			return cacheEntry{}, errors.New("unexpected lookup")
+		},
+		entries: map[string]cacheEntry{},
+	}
+	go daemon.serve(listener)
+
+	// The daemon closes the connection of a client sending no request
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("closed connection expected, read %v bytes: %v", n, err)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+var dnsNameRegexp = regexp.MustCompile(`^([a-z0-9]([-a-z0-9]*[a-z0-9])?\.)+[a-z0-9]([-a-z0-9]*[a-z0-9])?\.?$`)
+
+// lookupHost resolves the custom DNS names, replaced in tests
+var lookupHost = net.DefaultResolver.LookupHost
+
+// checks if host is a DNS name, with at least two labels unlike an instance
+// name
+func isDNSName(host string) bool {
+	return strings.Contains(host, ".") && parseIP(host) == nil && dnsNameRegexp.MatchString(strings.ToLower(host))
+}
+
+// Parses the GCP internal DNS name of an instance, the zonal
+// INSTANCE.ZONE.c.PROJECT.internal or the global INSTANCE.c.PROJECT.internal
+// without the zone
+func parseInternalDNS(host string) (instance, zone, project string, ok bool) {
+	name := strings.TrimSuffix(strings.ToLower(host), ".")
+	if !strings.HasSuffix(name, ".internal") {
+		return "", "", "", false
+	}
+	labels := strings.Split(strings.TrimSuffix(name, ".internal"), ".")
+	switch {
+	case len(labels) == 4 && labels[2] == "c":
+		instance, zone, project = labels[0], labels[1], labels[3]
+	case len(labels) == 3 && labels[1] == "c":
+		instance, project = labels[0], labels[2]
+	default:
+		return "", "", "", false
+	}
+	return instance, zone, project, isInstanceName(instance)
+}
+
+// finds the instance of a DNS name. The internal DNS names tell the instance
+// searched by name in their project and zone, the other names are looked up
+// to search their IP.
+func lookupDNSName(ctx context.Context, cfg *Config, cache *resolutionCache, host string) (cacheEntry, error) {
+	instance, zone, project, ok := parseInternalDNS(host)
+	if !ok {
+		addrs, err := lookupHost(ctx, host)
+		if err != nil {
+			return cacheEntry{}, fmt.Errorf("%w: cannot look up %q: %v", ErrInvalidDestination, host, err)
+		}
+		for _, addr := range addrs {
+			if parseIP(addr) != nil {
+				logger.Debugf("Looked up %s: %s", host, addr)
+				return lookupInstance(ctx, cfg, cache, addr)
+			}
+		}
+		return cacheEntry{}, fmt.Errorf("%w: %s has no IP", ErrInstanceNotFound, host)
+	}
+
+	if entry, ok := cache.Get(host); ok {
+		logger.With("project", entry.Project, "zone", entry.Zone, "instance", entry.Instance, "host", host).Infof("Found cached host: %s in zone: %s with name: %s", host, entry.Zone, entry.Instance)
+		stats.Incr("gcloud_ssh.resolve.hit", "source:cache")
+		return entry, nil
+	}
+	// Only the name zone, or all the zones of its project, are searched. The
+	// cache and daemon keyed by instance names of other projects are not
+	// asked.
+	scoped := *cfg
+	scoped.Projects, scoped.Folder, scoped.Zones, scoped.Regions = []string{project}, "", nil, nil
+	if zone != "" {
+		scoped.Zones = []string{zone}
+	}
+	scoped.Socket = ""
+	entry, err := lookupInstance(ctx, &scoped, nil, instance)
+	if err != nil {
+		return entry, err
+	}
+	cache.Put(host, entry)
+	return entry, nil
+}
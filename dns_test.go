@@ -0,0 +1,86 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestParseInternalDNS(t *testing.T) {
+	for _, test := range []struct {
+		host                    string
+		instance, zone, project string
+		ok                      bool
+	}{
+		{"vm-1.us-central1-a.c.project-1.internal", "vm-1", "us-central1-a", "project-1", true},
+		{"vm-1.us-central1-a.c.project-1.internal.", "vm-1", "us-central1-a", "project-1", true},
+		{"VM-1.US-CENTRAL1-A.C.PROJECT-1.INTERNAL", "vm-1", "us-central1-a", "project-1", true},
+		{"vm-1.c.project-1.internal", "vm-1", "", "project-1", true},
+		{"vm-1.us-central1-a.project-1.internal", "", "", "", false},
+		{"vm-1.example.com", "", "", "", false},
+		{"vm-1", "", "", "", false},
+	} {
+		instance, zone, project, ok := parseInternalDNS(test.host)
+		if ok != test.ok || instance != test.instance || zone != test.zone || project != test.project {
+			t.Fatalf("%v: unexpected parsing: %v %v %v %v", test.host, instance, zone, project, ok)
+		}
+	}
+	for host, expected := range map[string]bool{
+		"vm-1.us-central1-a.c.project-1.internal": true,
+		"vm-1.example.com":                        true,
+		"vm-1":                                    false,
+		"172.16.0.11":                             false,
+		"vm_1.example.com":                        false,
+	} {
+		if isDNSName(host) != expected {
+			t.Fatalf("%v: '%v' != '%v'", host, !expected, expected)
+		}
+	}
+}
+
+func TestLookupDNSName(t *testing.T) {
+	var paths []string
+	stubComputeService(t, func(req *http.Request) (*http.Response, error) {
+		paths = append(paths, req.URL.Path)
+		if req.URL.Path == "/compute/v1/projects/project-2/zones/us-central1-b/instances" {
+			return jsonResponse(http.StatusOK, `{"items": [{"name": "vm-1", "networkInterfaces": [{"networkIP": "10.0.0.2"}]}]}`), nil
+		}
+		return jsonResponse(http.StatusOK, aggregatedListResponse), nil
+	})
+	defer func(original func(context.Context, string) ([]string, error)) { lookupHost = original }(lookupHost)
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"172.16.0.11"}, nil
+	}
+
+	// The internal DNS name is searched in its own project and zone
+	cfg := &Config{Projects: []string{"project-1"}, Zones: []string{"us-central1-a"}, MaxRetries: 4, Concurrency: 1}
+	a := AnsibleRun{Destination: "andy@vm-1.us-central1-b.c.project-2.internal"}
+	if err := updateWithInstanceName(context.Background(), cfg, nil, &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Destination != "andy@vm-1" || a.Zone != "us-central1-b" || a.Project != "project-2" {
+		t.Fatalf("unexpected resolution: %v %v %v", a.Destination, a.Zone, a.Project)
+	}
+	if len(paths) != 1 {
+		t.Fatalf("unexpected searches: %v", paths)
+	}
+
+	// Other names are searched by their IP
+	paths = nil
+	cfg.Zones = nil
+	a = AnsibleRun{Destination: "vm-1.example.com"}
+	if err := updateWithInstanceName(context.Background(), cfg, nil, &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Destination != "instance-1" || a.Project != "project-1" {
+		t.Fatalf("unexpected resolution: %v %v", a.Destination, a.Project)
+	}
+	if len(paths) != 1 || paths[0] != "/compute/v1/projects/project-1/aggregated/instances" {
+		t.Fatalf("unexpected searches: %v", paths)
+	}
+}
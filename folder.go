@@ -0,0 +1,147 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	cloudresourcemanager "google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/option"
+)
+
+var (
+	// buildResourceManagerService creates the shared resource manager API
+	// client, replaced in tests
+	buildResourceManagerService = newResourceManagerService
+
+	resourceManagerServiceOnce   sync.Once
+	sharedResourceManagerService *cloudresourcemanager.Service
+	resourceManagerServiceErr    error
+
+	// folderProjects are the projects of the folders already expanded, they
+	// are expanded again after the cache TTL
+	folderProjectsMu sync.Mutex
+	folderProjects   = map[string]folderExpansion{}
+)
+
+type folderExpansion struct {
+	projects []string
+	time     time.Time
+}
+
+// Creates the resource manager API client expanding the folder projects
+func newResourceManagerService(ctx context.Context, cfg *Config) (*cloudresourcemanager.Service, error) {
+	opts := []option.ClientOption{option.WithUserAgent("gcloud-ssh/" + version)}
+	credentials, err := credentialOptions(ctx, cfg, cloudresourcemanager.CloudPlatformReadOnlyScope)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, credentials...)
+	if cfg.QuotaProject != "" {
+		opts = append(opts, option.WithQuotaProject(cfg.QuotaProject))
+	}
+	return cloudresourcemanager.NewService(ctx, opts...)
+}
+
+// Gets the resource manager API client shared by the process, it is created
+// on first use
+func getResourceManagerService(cfg *Config) (*cloudresourcemanager.Service, error) {
+	resourceManagerServiceOnce.Do(func() {
+		sharedResourceManagerService, resourceManagerServiceErr = buildResourceManagerService(context.Background(), cfg)
+	})
+	return sharedResourceManagerService, resourceManagerServiceErr
+}
+
+// Parses the folder as a projects list filter on its parent, a bare ID is a
+// folder one
+func folderParent(folder string) (string, error) {
+	if folder == "" {
+		return "", nil
+	}
+	parentType, id := "folder", folder
+	if i := strings.Index(folder, "/"); i >= 0 {
+		switch folder[:i] {
+		case "folders":
+		case "organizations":
+			parentType = "organization"
+		default:
+			return "", fmt.Errorf("Invalid folder: %q, expected folders/<id> or organizations/<id>", folder)
+		}
+		id = folder[i+1:]
+	}
+	if id == "" || strings.Trim(id, "0123456789") != "" {
+		return "", fmt.Errorf("Invalid folder: %q, expected a numeric ID", folder)
+	}
+	return fmt.Sprintf("parent.type:%s parent.id:%s", parentType, id), nil
+}
+
+// Gets cfg.Projects followed by the active child projects of cfg.Folder
+func searchedProjects(ctx context.Context, cfg *Config) ([]string, error) {
+	if cfg.Folder == "" {
+		return cfg.Projects, nil
+	}
+	children, err := getFolderProjects(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	projects := append([]string{}, cfg.Projects...)
+	seen := map[string]bool{}
+	for _, project := range projects {
+		seen[project] = true
+	}
+	for _, project := range children {
+		if !seen[project] {
+			seen[project] = true
+			projects = append(projects, project)
+		}
+	}
+	return projects, nil
+}
+
+// Gets the active child projects of cfg.Folder, from memory when expanded
+// less than cfg.CacheTTL ago
+func getFolderProjects(ctx context.Context, cfg *Config) ([]string, error) {
+	folderProjectsMu.Lock()
+	expansion, ok := folderProjects[cfg.Folder]
+	folderProjectsMu.Unlock()
+	if ok && time.Since(expansion.time) < cfg.CacheTTL {
+		return expansion.projects, nil
+	}
+
+	parent, err := folderParent(cfg.Folder)
+	if err != nil {
+		return nil, err
+	}
+	resourceManagerService, err := getResourceManagerService(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create the resource manager API client: %w", err)
+	}
+	projectsListCall := resourceManagerService.Projects.List()
+	projectsListCall.Filter(parent + " lifecycleState:ACTIVE")
+	var projects []string
+	err = withRetry(ctx, cfg.MaxRetries, func() error {
+		projects = nil
+		return projectsListCall.Pages(ctx, func(projectList *cloudresourcemanager.ListProjectsResponse) error {
+			for _, project := range projectList.Projects {
+				projects = append(projects, project.ProjectId)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list the projects of %s: %w", cfg.Folder, err)
+	}
+	logger.Debugf("Expanded %s to projects: %v", cfg.Folder, projects)
+
+	folderProjectsMu.Lock()
+	folderProjects[cfg.Folder] = folderExpansion{projects: projects, time: time.Now()}
+	folderProjectsMu.Unlock()
+	return projects, nil
+}
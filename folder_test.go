@@ -0,0 +1,96 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cloudresourcemanager "google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/option"
+)
+
+func TestFindInstanceFolder(t *testing.T) {
+	defer func(original func(context.Context, *Config) (*cloudresourcemanager.Service, error)) {
+		buildResourceManagerService = original
+		resourceManagerServiceOnce = sync.Once{}
+		folderProjects = map[string]folderExpansion{}
+	}(buildResourceManagerService)
+	resourceManagerServiceOnce = sync.Once{}
+	var filters []string
+	buildResourceManagerService = func(ctx context.Context, cfg *Config) (*cloudresourcemanager.Service, error) {
+		transport := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			filters = append(filters, req.URL.Query().Get("filter"))
+			if req.URL.Query().Get("pageToken") == "" {
+				return jsonResponse(http.StatusOK, `{"projects": [{"projectId": "project-1"}, {"projectId": "project-2"}], "nextPageToken": "page-2"}`), nil
+			}
+			return jsonResponse(http.StatusOK, `{"projects": [{"projectId": "project-3"}]}`), nil
+		})
+		return cloudresourcemanager.NewService(ctx, option.WithHTTPClient(&http.Client{Transport: transport}))
+	}
+
+	var mu sync.Mutex
+	var searched []string
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		project := strings.Split(strings.TrimPrefix(req.URL.Path, "/compute/v1/projects/"), "/")[0]
+		searched = append(searched, project)
+		if project != "project-3" {
+			return jsonResponse(http.StatusOK, `{}`), nil
+		}
+		return jsonResponse(http.StatusOK, aggregatedListResponse), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1"}, Folder: "folders/123", CacheTTL: time.Minute, MaxRetries: 4, Concurrency: 1}
+	for i := 0; i < 2; i++ {
+		searched = nil
+		_, _, project, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if project != "project-3" {
+			t.Fatalf("'%v' != '%v'", project, "project-3")
+		}
+		sort.Strings(searched)
+		if expected := []string{"project-1", "project-2", "project-3"}; !reflect.DeepEqual(searched, expected) {
+			t.Fatalf("'%v' != '%v'", searched, expected)
+		}
+	}
+	// The expansion is cached, every page was listed once
+	expected := []string{"parent.type:folder parent.id:123 lifecycleState:ACTIVE", "parent.type:folder parent.id:123 lifecycleState:ACTIVE"}
+	if !reflect.DeepEqual(filters, expected) {
+		t.Fatalf("'%v' != '%v'", filters, expected)
+	}
+}
+
+func TestFolderParent(t *testing.T) {
+	for folder, expected := range map[string]string{
+		"":                  "",
+		"123":               "parent.type:folder parent.id:123",
+		"folders/123":       "parent.type:folder parent.id:123",
+		"organizations/456": "parent.type:organization parent.id:456",
+	} {
+		parent, err := folderParent(folder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent != expected {
+			t.Fatalf("'%v' != '%v'", parent, expected)
+		}
+	}
+	for _, folder := range []string{"projects/123", "folders/", "folders/abc", "my-folder"} {
+		if _, err := folderParent(folder); err == nil {
+			t.Fatalf("%v: error expected", folder)
+		}
+	}
+}
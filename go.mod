@@ -3,6 +3,7 @@ module github.com/retailnext/gcloud-ssh
 go 1.14
 
 require (
-	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
-	google.golang.org/api v0.30.0
+	golang.org/x/oauth2 v0.0.0-20210628180205-a41e5a781914
+	google.golang.org/api v0.50.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,99 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// iapTunnelAddr is the IAP TCP forwarding endpoint gcloud tunnels through
+var iapTunnelAddr = "tunnel.cloudproxy.app:443"
+
+// checks if the wrapper is asked for a healthcheck instead of running ssh or
+// scp, ansible never passes a healthcheck first argument
+func isHealthcheckRequest(args []string) bool {
+	return len(args) > 1 && args[1] == "healthcheck"
+}
+
+// Checks the compute API credentials, the IAP endpoint and the resolution of
+// the optional hosts, returning the exit code
+func healthcheck(ctx context.Context, cfg *Config, hosts []string, out io.Writer) int {
+	computeService, err := getComputeService(cfg)
+	if err != nil {
+		fmt.Fprintf(out, "FAIL compute client: %v\n", err)
+		return 1
+	}
+	if !runHealthcheck(ctx, cfg, computeService, hosts, out) {
+		return 1
+	}
+	return 0
+}
+
+// Runs every check printing a line for each of them, true when all pass
+func runHealthcheck(ctx context.Context, cfg *Config, computeService *compute.Service, hosts []string, out io.Writer) bool {
+	healthy := true
+	report := func(err error, format string, v ...interface{}) {
+		status := "OK"
+		if err != nil {
+			status, healthy = "FAIL", false
+		}
+		fmt.Fprintf(out, "%s %s", status, fmt.Sprintf(format, v...))
+		if err != nil {
+			fmt.Fprintf(out, ": %v", err)
+		}
+		fmt.Fprintln(out)
+	}
+
+	if cfg.Zone != "" && cfg.Project != "" {
+		// The lookups only search the GCLOUD_SSH_ZONE zone
+		cfg = zoneConfig(cfg)
+	}
+	projects, err := searchedProjects(ctx, cfg)
+	if cfg.Folder != "" {
+		report(err, "resource manager API access to: %s", cfg.Folder)
+	}
+	if err != nil {
+		projects = cfg.Projects
+	}
+	for _, project := range projects {
+		// Each project is checked with the credentials it is searched with
+		service, err := projectComputeService(cfg, computeService, project)
+		if err == nil {
+			zonesCall := service.Zones.List(project)
+			zonesCall.MaxResults(1)
+			zonesCall.Context(ctx)
+			err = withRetry(ctx, cfg.MaxRetries, func() error {
+				_, err := zonesCall.Do()
+				return err
+			})
+		}
+		report(err, "compute API access to project: %s", project)
+	}
+
+	if cfg.UseIAP {
+		conn, err := net.DialTimeout("tcp", iapTunnelAddr, 5*time.Second)
+		if err == nil {
+			conn.Close()
+		}
+		report(err, "IAP endpoint: %s", iapTunnelAddr)
+	}
+
+	for _, host := range hosts {
+		find := findInstance
+		if parseIP(host) == nil {
+			find = findInstanceByName
+		}
+		instanceName, zone, project, err := find(ctx, computeService, cfg, host)
+		report(err, "resolution of %s to project: %s zone: %s instance: %s", host, project, zone, instanceName)
+	}
+	return healthy
+}
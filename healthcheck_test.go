@@ -0,0 +1,87 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHealthcheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	defer func(original string) { iapTunnelAddr = original }(iapTunnelAddr)
+	iapTunnelAddr = listener.Addr().String()
+
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/zones") {
+			if strings.Contains(req.URL.Path, "/projects/project-2/") {
+				return jsonResponse(http.StatusForbidden, `{"error": {"code": 403, "message": "Forbidden"}}`), nil
+			}
+			return jsonResponse(http.StatusOK, `{"items": [{"name": "us-central1-a"}]}`), nil
+		}
+		return jsonResponse(http.StatusOK, aggregatedListResponse), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1"}, UseIAP: true, MaxRetries: 4, Concurrency: 8}
+	var out bytes.Buffer
+	if !runHealthcheck(context.Background(), cfg, computeService, []string{"172.16.0.11"}, &out) {
+		t.Fatalf("healthy expected:\n%s", out.String())
+	}
+	for _, expected := range []string{
+		"OK compute API access to project: project-1",
+		"OK IAP endpoint: " + iapTunnelAddr,
+		"OK resolution of 172.16.0.11 to project: project-1 zone: us-central1-a instance: instance-1",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("'%v' expected in:\n%s", expected, out.String())
+		}
+	}
+
+	cfg.Projects = []string{"project-2"}
+	out.Reset()
+	if runHealthcheck(context.Background(), cfg, computeService, nil, &out) {
+		t.Fatalf("unhealthy expected:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "FAIL compute API access to project: project-2") {
+		t.Fatalf("failed check expected in:\n%s", out.String())
+	}
+}
+
+func TestHealthcheckZoneOverride(t *testing.T) {
+	var requested []string
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		requested = append(requested, req.URL.Path)
+		if strings.HasSuffix(req.URL.Path, "/zones") {
+			return jsonResponse(http.StatusOK, `{"items": [{"name": "us-central1-a"}]}`), nil
+		}
+		return jsonResponse(http.StatusOK, `{"items": [{"name": "instance-1", "networkInterfaces": [{"networkIP": "172.16.0.11"}]}]}`), nil
+	})
+
+	cfg := &Config{Zone: "us-central1-a", Project: "project-1", MaxRetries: 4, Concurrency: 8}
+	var out bytes.Buffer
+	if !runHealthcheck(context.Background(), cfg, computeService, []string{"172.16.0.11"}, &out) {
+		t.Fatalf("healthy expected:\n%s", out.String())
+	}
+	for _, expected := range []string{
+		"OK compute API access to project: project-1",
+		"OK resolution of 172.16.0.11 to project: project-1 zone: us-central1-a instance: instance-1",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("'%v' expected in:\n%s", expected, out.String())
+		}
+	}
+	if len(requested) != 2 || !strings.HasSuffix(requested[1], "/projects/project-1/zones/us-central1-a/instances") {
+		t.Fatalf("unexpected requests: %v", requested)
+	}
+}
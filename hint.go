@@ -0,0 +1,79 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import "regexp"
+
+// gcloudFailures are the gcloud stderr signatures of the common connection
+// failures with the hint given for them
+var gcloudFailures = []struct {
+	signature *regexp.Regexp
+	hint      string
+}{
+	{regexp.MustCompile(`4033: 'not authorized'|iap\.tunnelInstances\.accessViaIAP`), "IAP tunnel not authorized: ensure the account has roles/iap.tunnelResourceAccessor on the instance"},
+	{regexp.MustCompile(`4003: 'failed to connect to backend'`), "IAP tunnel failed: ensure a firewall rule allows the 35.235.240.0/20 range to the ssh port and the instance is ready"},
+	{regexp.MustCompile(`Connection closed by .* port 65535|Connection reset by .* port 65535`), "IAP tunnel closed: the instance may still be booting or its ssh server not running"},
+	{regexp.MustCompile(`Permission denied \(publickey`), "Ssh key rejected: ensure the key is in the instance or project metadata, or the OS Login roles with GCLOUD_SSH_OS_LOGIN"},
+	{regexp.MustCompile(`The resource '[^']*/instances/[^']*' was not found`), "Instance not found: it may have been deleted or recreated since it was resolved"},
+	{fingerprintConflict, "Ssh key metadata conflict: concurrent runs updated the metadata, GCLOUD_SSH_SKIP_KEY_PROPAGATION avoids the updates"},
+}
+
+// fingerprintConflict is the gcloud failure to add the ssh key to metadata
+// updated concurrently by another run, retrying succeeds
+var fingerprintConflict = regexp.MustCompile(`fingerprint does not match current metadata fingerprint`)
+
+// tailBuffer keeps the last max bytes written to it
+type tailBuffer struct {
+	max  int
+	data []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	if len(b.data) > b.max {
+		b.data = b.data[len(b.data)-b.max:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	return string(b.data)
+}
+
+// hintError is a failed gcloud run with a hint about the cause
+type hintError struct {
+	hint string
+	err  error
+}
+
+func (e *hintError) Error() string {
+	return e.hint + ": " + e.err.Error()
+}
+
+func (e *hintError) Unwrap() error {
+	return e.err
+}
+
+// Gets the hint of the known failure gcloud reported in stderr if any
+func classifyGCloudError(stderr string) string {
+	for _, failure := range gcloudFailures {
+		if failure.signature.MatchString(stderr) {
+			return failure.hint
+		}
+	}
+	return ""
+}
+
+// Wraps the error of a failed gcloud run with the hint of its stderr
+func withHint(err error, stderr string) error {
+	if err == nil {
+		return nil
+	}
+	if hint := classifyGCloudError(stderr); hint != "" {
+		return &hintError{hint: hint, err: err}
+	}
+	return err
+}
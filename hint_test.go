@@ -0,0 +1,83 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClassifyGCloudError(t *testing.T) {
+	for stderr, expected := range map[string]string{
+		"ERROR: (gcloud.compute.start-iap-tunnel) Error while connecting [4033: 'not authorized'].":                                                          "roles/iap.tunnelResourceAccessor",
+		"ERROR: (gcloud.compute.start-iap-tunnel) Error while connecting [4003: 'failed to connect to backend'].\r\nkex_exchange_identification":             "35.235.240.0/20",
+		"kex_exchange_identification: Connection closed by remote host\r\nConnection closed by UNKNOWN port 65535":                                           "booting",
+		"andy_retailnext_net@compute.1234: Permission denied (publickey).":                                                                                   "OS Login",
+		"ERROR: (gcloud.compute.ssh) Could not fetch resource:\n - The resource 'projects/project-1/zones/us-central1-a/instances/instance-1' was not found": "recreated",
+		"ERROR: (gcloud.compute.ssh) Could not add SSH key to instance metadata:\n - Supplied fingerprint does not match current metadata fingerprint.":      "GCLOUD_SSH_SKIP_KEY_PROPAGATION",
+	} {
+		if hint := classifyGCloudError(stderr); !strings.Contains(hint, expected) {
+			t.Fatalf("%q: '%v' expected in '%v'", stderr, expected, hint)
+		}
+	}
+	if hint := classifyGCloudError("bash: line 1: python3: command not found"); hint != "" {
+		t.Fatalf("no hint expected, found '%v'", hint)
+	}
+
+	// The exit code of gcloud is still propagated
+	err := withHint(exec.Command("sh", "-c", "exit 255").Run(), "Error while connecting [4033: 'not authorized'].")
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitCode(err) != 255 || !strings.HasPrefix(err.Error(), "IAP tunnel not authorized") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := withHint(nil, "Error while connecting [4033: 'not authorized']."); err != nil {
+		t.Fatalf("'%v' != '%v'", err, nil)
+	}
+
+	tail := &tailBuffer{max: 4}
+	tail.Write([]byte("abc"))
+	tail.Write([]byte("def"))
+	if tail.String() != "cdef" {
+		t.Fatalf("'%v' != '%v'", tail.String(), "cdef")
+	}
+}
+
+func TestRunGCloudFingerprintRetry(t *testing.T) {
+	defer func(original Runner) { runner = original }(runner)
+	defer func(original time.Duration) { retryBaseDelay = original }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+	cfg := defaultConfig()
+	cfg.GcloudPath = "true"
+	ar := AnsibleRun{Command: "ls", Destination: "instance-1", Zone: "us-central1-a", Project: "project-1"}
+
+	for stderr, expected := range map[string]int{
+		// Concurrent metadata updates are retried until the run succeeds
+		"ERROR: (gcloud.compute.ssh) Could not add SSH key to instance metadata:\n - Supplied fingerprint does not match current metadata fingerprint.\n": 3,
+		// Genuine failures are not
+		"andy@instance-1: Permission denied (publickey).\n": 1,
+	} {
+		runs := 0
+		runner = func(name string, args []string, w io.Writer, timeout time.Duration) error {
+			runs++
+			if runs < 3 {
+				io.WriteString(w, stderr)
+				return errors.New("exit status 1")
+			}
+			return nil
+		}
+		err := runGCloudSSH(&cfg, ar)
+		if runs != expected {
+			t.Fatalf("%q: '%v' != '%v'", stderr, runs, expected)
+		}
+		if (err == nil) != (expected == 3) {
+			t.Fatalf("%q: unexpected error: %v", stderr, err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// postHookTimeout is the time the post hook has to run before it is killed
+var postHookTimeout = 30 * time.Second
+
+// Runs cfg.PostHook after a gcloud run with the resolved instance and the
+// exit code of the run. The hook is best effort, its failures are only
+// logged and never change the wrapper exit code.
+func runPostHook(cfg *Config, command string, ar AnsibleRun, runErr error) {
+	if cfg.PostHook == "" {
+		return
+	}
+	code := 0
+	if runErr != nil {
+		code = exitCode(runErr)
+	}
+	// The remote side is the destination unless scp is downloading files
+	target := ar.Destination
+	if ar.Download && len(ar.Sources) > 0 {
+		target = ar.Sources[0]
+	}
+
+	cmd := exec.Command(cfg.PostHook)
+	cmd.Env = append(os.Environ(),
+		"GCLOUD_SSH_RESULT_COMMAND="+command,
+		"GCLOUD_SSH_RESULT_HOST="+ar.Host,
+		"GCLOUD_SSH_RESULT_INSTANCE="+ExtractIP(target),
+		"GCLOUD_SSH_RESULT_ZONE="+ar.Zone,
+		"GCLOUD_SSH_RESULT_PROJECT="+ar.Project,
+		"GCLOUD_SSH_RESULT_EXIT_CODE="+strconv.Itoa(code),
+	)
+	// Ansible reads stdout as the command output
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := runCommand(cmd, postHookTimeout); err != nil {
+		logger.Warnf("Post hook %s failed: %v", cfg.PostHook, err)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRunPostHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcloud-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hook := filepath.Join(dir, "hook")
+	out := filepath.Join(dir, "env")
+	if err := ioutil.WriteFile(hook, []byte("#!/bin/sh\nenv | grep ^GCLOUD_SSH_RESULT_ > "+out+"\nexit 3\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := defaultConfig()
+	cfg.PostHook = hook
+	ansible := AnsibleRun{Command: "ls", Destination: "andy@instance-1", Host: "172.16.0.11", Zone: "us-central1-a", Project: "project-1"}
+	run := func(cfg *Config, ar AnsibleRun) error {
+		return exec.Command("sh", "-c", "exit 2").Run()
+	}
+	// The hook failure keeps the exit code of the run
+	err = runGCloud(&cfg, nil, "ssh", run, ansible, ansible)
+	if exitCode(err) != 2 {
+		t.Fatalf("'%v' != '%v'", exitCode(err), 2)
+	}
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := strings.Split(strings.TrimSpace(string(data)), "\n")
+	sort.Strings(env)
+	expected := []string{
+		"GCLOUD_SSH_RESULT_COMMAND=ssh",
+		"GCLOUD_SSH_RESULT_EXIT_CODE=2",
+		"GCLOUD_SSH_RESULT_HOST=172.16.0.11",
+		"GCLOUD_SSH_RESULT_INSTANCE=instance-1",
+		"GCLOUD_SSH_RESULT_PROJECT=project-1",
+		"GCLOUD_SSH_RESULT_ZONE=us-central1-a",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("'%v' != '%v'", env, expected)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// groupNameRegexp matches the characters not allowed in ansible group names
+var groupNameRegexp = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// checks if the wrapper is asked for an ansible inventory instead of running
+// ssh or scp, ansible never passes an inventory first argument
+func isInventoryRequest(args []string) bool {
+	return len(args) > 1 && args[1] == "inventory"
+}
+
+// inventoryHost holds the hostvars of an inventory host
+type inventoryHost struct {
+	Name    string            `json:"gcp_name"`
+	Zone    string            `json:"gcp_zone"`
+	Project string            `json:"gcp_project"`
+	Labels  map[string]string `json:"gcp_labels"`
+}
+
+// inventoryGroup is an ansible inventory group
+type inventoryGroup struct {
+	Hosts    []string `json:"hosts,omitempty"`
+	Children []string `json:"children,omitempty"`
+}
+
+// Prints the ansible dynamic inventory of the instances searched, keyed by
+// their network IP, returning the exit code. Like an inventory script it
+// answers --list and --host, --group-by-label=<key> groups the hosts by the
+// values of a label.
+func inventory(ctx context.Context, cfg *Config, args []string, out, errOut io.Writer) int {
+	var groupByLabels []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--list":
+		case arg == "--host":
+			// The hostvars are all in _meta
+			fmt.Fprintln(out, "{}")
+			return 0
+		case arg == "--group-by-label" && i+1 < len(args):
+			i++
+			groupByLabels = append(groupByLabels, args[i])
+		case strings.HasPrefix(arg, "--group-by-label="):
+			groupByLabels = append(groupByLabels, strings.TrimPrefix(arg, "--group-by-label="))
+		default:
+			fmt.Fprintf(errOut, "Invalid inventory argument: %q\n", arg)
+			return 2
+		}
+	}
+
+	computeService, err := getComputeService(cfg)
+	if err == nil {
+		var result map[string]interface{}
+		if result, err = buildInventory(ctx, cfg, computeService, groupByLabels); err == nil {
+			err = json.NewEncoder(out).Encode(result)
+		}
+	}
+	if err != nil {
+		logger.Errorf("%v", err)
+		fmt.Fprintln(errOut, err)
+		return 1
+	}
+	return 0
+}
+
+// Lists the instances searched in every project and zone as an ansible
+// inventory, in the format of ansible-inventory --list
+func buildInventory(ctx context.Context, cfg *Config, computeService *compute.Service, groupByLabels []string) (map[string]interface{}, error) {
+	hostvars := map[string]inventoryHost{}
+	groups := map[string]*inventoryGroup{}
+	ungrouped := &inventoryGroup{}
+	if cfg.Zone != "" && cfg.Project != "" {
+		// Only the instances of the GCLOUD_SSH_ZONE zone can be connected to
+		cfg = zoneConfig(cfg)
+	}
+	scopes, err := searchScopes(ctx, computeService, cfg)
+	if err != nil {
+		return nil, err
+	}
+	// The projects or zones that can't be listed are skipped, like in the
+	// searches, the inventory only fails when none of them can be
+	var errs searchErrors
+	for _, scope := range scopes {
+		service, err := projectComputeService(cfg, computeService, scope.project)
+		var instances []listedInstance
+		if err == nil {
+			instances, err = listInstances(ctx, service, scope, instanceFilter(cfg), cfg.MaxRetries, nil)
+		}
+		if err != nil {
+			scopeLogger := logger.With("project", scope.project, "zone", scope.zone)
+			if isPermissionDenied(err) {
+				scopeLogger.Warnf("Skipping project: %s zone: %s without permission: %v", scope.project, scope.zone, err)
+			} else {
+				scopeLogger.Warnf("Cannot list instances in project: %s zone: %s: %v", scope.project, scope.zone, err)
+			}
+			errs = append(errs, err)
+			continue
+		}
+		for _, listed := range instances {
+			instance := listed.instance
+			ip := inventoryIP(cfg, instance)
+			if ip == "" || (cfg.RequireIAPTag != "" && !hasTag(instance, cfg.RequireIAPTag)) {
+				continue
+			}
+			if existing, ok := hostvars[ip]; ok {
+				// The wrapper can't tell which one ansible connects to
+				logger.Warnf("Skipping instance: %s in project: %s with the IP %s of instance: %s in project: %s", instance.Name, scope.project, ip, existing.Name, existing.Project)
+				continue
+			}
+			hostvars[ip] = inventoryHost{Name: instance.Name, Zone: listed.zone, Project: scope.project, Labels: instance.Labels}
+
+			grouped := false
+			for _, key := range groupByLabels {
+				value, ok := instance.Labels[key]
+				if !ok {
+					continue
+				}
+				name := groupNameRegexp.ReplaceAllString(key+"_"+value, "_")
+				if groups[name] == nil {
+					groups[name] = &inventoryGroup{}
+				}
+				groups[name].Hosts = append(groups[name].Hosts, ip)
+				grouped = true
+			}
+			if !grouped {
+				ungrouped.Hosts = append(ungrouped.Hosts, ip)
+			}
+		}
+	}
+
+	if len(errs) > 0 && len(errs) == len(scopes) {
+		return nil, fmt.Errorf("Inventory failed in every project: %w", errs)
+	}
+
+	all := &inventoryGroup{}
+	result := map[string]interface{}{
+		"_meta": map[string]interface{}{"hostvars": hostvars},
+		"all":   all,
+	}
+	for name, group := range groups {
+		sort.Strings(group.Hosts)
+		all.Children = append(all.Children, name)
+		result[name] = group
+	}
+	sort.Strings(all.Children)
+	all.Children = append(all.Children, "ungrouped")
+	sort.Strings(ungrouped.Hosts)
+	result["ungrouped"] = ungrouped
+	return result, nil
+}
+
+// Gets the network IP an instance is connected to, the one of its first
+// interface on the searched network
+func inventoryIP(cfg *Config, instance *compute.Instance) string {
+	for _, ni := range instance.NetworkInterfaces {
+		if ni.NetworkIP != "" && inHostProject(ni, cfg.HostProject) && inNetwork(ni, cfg.Network) {
+			return ni.NetworkIP
+		}
+	}
+	return ""
+}
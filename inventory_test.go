@@ -0,0 +1,108 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuildInventory(t *testing.T) {
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		if filter := req.URL.Query().Get("filter"); filter != "(status = RUNNING)" {
+			t.Fatalf("unexpected filter: %v", filter)
+		}
+		return jsonResponse(http.StatusOK, `{"items": {
+			"zones/us-central1-a": {"instances": [
+				{"name": "instance-1", "labels": {"env": "prod"}, "networkInterfaces": [{"networkIP": "172.16.0.11"}]},
+				{"name": "instance-2", "labels": {"env": "dev.1"}, "networkInterfaces": [{"networkIP": "172.16.0.12"}]}
+			]},
+			"zones/us-central1-b": {"instances": [
+				{"name": "instance-3", "networkInterfaces": [{"networkIP": "172.16.0.13"}]}
+			]}
+		}}`), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1"}, StatusFilter: []string{"RUNNING"}, MaxRetries: 4}
+	result, err := buildInventory(context.Background(), cfg, computeService, []string{"env"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inventory map[string]interface{}
+	if err := json.Unmarshal(data, &inventory); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"_meta": map[string]interface{}{"hostvars": map[string]interface{}{
+			"172.16.0.11": map[string]interface{}{"gcp_name": "instance-1", "gcp_zone": "us-central1-a", "gcp_project": "project-1", "gcp_labels": map[string]interface{}{"env": "prod"}},
+			"172.16.0.12": map[string]interface{}{"gcp_name": "instance-2", "gcp_zone": "us-central1-a", "gcp_project": "project-1", "gcp_labels": map[string]interface{}{"env": "dev.1"}},
+			"172.16.0.13": map[string]interface{}{"gcp_name": "instance-3", "gcp_zone": "us-central1-b", "gcp_project": "project-1", "gcp_labels": nil},
+		}},
+		"all":       map[string]interface{}{"children": []interface{}{"env_dev_1", "env_prod", "ungrouped"}},
+		"env_prod":  map[string]interface{}{"hosts": []interface{}{"172.16.0.11"}},
+		"env_dev_1": map[string]interface{}{"hosts": []interface{}{"172.16.0.12"}},
+		"ungrouped": map[string]interface{}{"hosts": []interface{}{"172.16.0.13"}},
+	}
+	if !reflect.DeepEqual(inventory, expected) {
+		t.Fatalf("'%v' != '%v'", inventory, expected)
+	}
+}
+
+func TestBuildInventorySkipsFailedProjects(t *testing.T) {
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/projects/project-1/") {
+			return jsonResponse(http.StatusForbidden, `{"error": {"code": 403, "message": "Forbidden"}}`), nil
+		}
+		return jsonResponse(http.StatusOK, aggregatedListResponse), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1", "project-2"}, MaxRetries: 4}
+	result, err := buildInventory(context.Background(), cfg, computeService, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostvars := result["_meta"].(map[string]interface{})["hostvars"].(map[string]inventoryHost)
+	if len(hostvars) != 1 || hostvars["172.16.0.11"].Project != "project-2" {
+		t.Fatalf("unexpected hosts: %v", hostvars)
+	}
+
+	// Without any project listed the inventory fails
+	cfg.Projects = []string{"project-1"}
+	if _, err := buildInventory(context.Background(), cfg, computeService, nil); err == nil || !isPermissionDenied(err) {
+		t.Fatalf("permission error expected, found: %v", err)
+	}
+}
+
+func TestBuildInventoryZoneOverride(t *testing.T) {
+	var listed []string
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		listed = append(listed, req.URL.Path)
+		return jsonResponse(http.StatusOK, `{"items": [{"name": "instance-1", "networkInterfaces": [{"networkIP": "172.16.0.11"}]}]}`), nil
+	})
+
+	cfg := &Config{Zone: "us-central1-a", Project: "project-1", MaxRetries: 4}
+	result, err := buildInventory(context.Background(), cfg, computeService, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostvars := result["_meta"].(map[string]interface{})["hostvars"].(map[string]inventoryHost)
+	expected := map[string]inventoryHost{"172.16.0.11": {Name: "instance-1", Zone: "us-central1-a", Project: "project-1"}}
+	if !reflect.DeepEqual(hostvars, expected) {
+		t.Fatalf("'%v' != '%v'", hostvars, expected)
+	}
+	if !reflect.DeepEqual(listed, []string{"/compute/v1/projects/project-1/zones/us-central1-a/instances"}) {
+		t.Fatalf("unexpected listings: %v", listed)
+	}
+}
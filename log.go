@@ -0,0 +1,278 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+func (l logLevel) String() string {
+	for name, level := range logLevelNames {
+		if level == l {
+			return name
+		}
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	level, ok := logLevelNames[strings.ToLower(name)]
+	if !ok {
+		return levelDebug, fmt.Errorf("Invalid log level: %q", name)
+	}
+	return level, nil
+}
+
+// Logger writes leveled log records, either as plain text lines through the
+// standard logger or as JSON records. Records can carry fields like the
+// resolved project, zone and instance.
+type Logger struct {
+	level logLevel
+	json  bool
+	// out is the standard logger output when nil
+	out    io.Writer
+	fields map[string]interface{}
+	mu     *sync.Mutex
+}
+
+// logger is the wrapper logger, everything is logged until configured
+var logger = &Logger{level: levelDebug, mu: &sync.Mutex{}}
+
+// Sets the record format, "text" or "json", and the minimum level logged
+func (l *Logger) configure(format, level string) error {
+	switch format {
+	case "", "text":
+		l.json = false
+	case "json":
+		l.json = true
+	default:
+		return fmt.Errorf("Invalid log format: %q", format)
+	}
+	var err error
+	l.level, err = parseLogLevel(level)
+	return err
+}
+
+// Returns a logger adding the key value pairs as fields to every record
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	child := *l
+	child.fields = make(map[string]interface{}, len(l.fields)+len(keyValues)/2)
+	for k, v := range l.fields {
+		child.fields[k] = v
+	}
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		child.fields[fmt.Sprint(keyValues[i])] = keyValues[i+1]
+	}
+	return &child
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.output(levelDebug, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.output(levelInfo, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.output(levelWarn, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.output(levelError, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) output(level logLevel, message string) {
+	if level < l.level {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := l.out
+	if out == nil {
+		out = log.Writer()
+	}
+
+	if l.json {
+		record := make(map[string]interface{}, len(l.fields)+3)
+		for k, v := range l.fields {
+			record[k] = v
+		}
+		record["time"] = time.Now().Format(time.RFC3339Nano)
+		record["level"] = level.String()
+		record["msg"] = message
+		data, err := json.Marshal(record)
+		if err != nil {
+			data, _ = json.Marshal(map[string]string{"level": level.String(), "msg": message, "error": err.Error()})
+		}
+		out.Write(append(data, '\n'))
+		return
+	}
+
+	// Plain text keeps the standard logger lines
+	switch level {
+	case levelWarn:
+		message = "WARNING: " + message
+	case levelError:
+		message = "ERROR: " + message
+	}
+	keys := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		message += fmt.Sprintf(" %s=%v", k, l.fields[k])
+	}
+	text := log.New(out, log.Prefix(), log.Flags())
+	text.Output(3, message)
+}
+
+// rotatingFile is a log file rotated when it grows over maxBytes, keeping up
+// to maxFiles backups from path.1, the newest, to path.<maxFiles>
+type rotatingFile struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// Opens the log file for appending, it is never rotated if maxBytes is 0
+func openRotatingFile(path string, maxBytes int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxBytes: maxBytes, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	r.f = f
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxBytes > 0 {
+		if err := r.rotateIfFull(int64(len(p))); err != nil {
+			return 0, err
+		}
+	}
+	return r.f.Write(p)
+}
+
+// Rotates the file when writing n more bytes grows it over maxBytes. Other
+// wrapper processes append to and rotate the same file, so it is only rotated
+// under the lock, once it is checked again that no other process did it.
+func (r *rotatingFile) rotateIfFull(n int64) error {
+	if !r.full(n) {
+		return nil
+	}
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if !r.full(n) {
+		return nil
+	}
+	return r.rotate()
+}
+
+// Checks whether writing n more bytes grows the file at path over maxBytes.
+// The file is reopened first when another process rotated it, the bytes are
+// written to the file at path instead of its rotated backup.
+func (r *rotatingFile) full(n int64) bool {
+	info, err := os.Stat(r.path)
+	if err != nil && !os.IsNotExist(err) {
+		return false
+	}
+	if current, statErr := r.f.Stat(); err != nil || statErr != nil || !os.SameFile(info, current) {
+		r.f.Close()
+		if err := r.open(); err != nil {
+			return false
+		}
+		if info, err = r.f.Stat(); err != nil {
+			return false
+		}
+	}
+	return info.Size() > 0 && info.Size()+n > r.maxBytes
+}
+
+// Locks the rotation against other wrapper processes
+func (r *rotatingFile) lock() (func(), error) {
+	f, err := os.OpenFile(r.path+".lock", os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	if r.maxFiles > 0 {
+		for i := r.maxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		os.Rename(r.path, r.path+".1")
+	} else {
+		os.Remove(r.path)
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Sync()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := &Logger{out: &buf, mu: &sync.Mutex{}}
+	if err := l.configure("json", "info"); err != nil {
+		t.Fatal(err)
+	}
+
+	l.Debugf("Parsed ansible ssh: %v", "noise")
+	l.With("project", "project-1", "zone", "us-central1-a", "instance", "instance-1", "networkIP", "172.16.0.11").Infof("Found %s", "instance-1")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("debug records must be suppressed: %v", lines)
+	}
+	record := map[string]string{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"level":     "info",
+		"msg":       "Found instance-1",
+		"project":   "project-1",
+		"zone":      "us-central1-a",
+		"instance":  "instance-1",
+		"networkIP": "172.16.0.11",
+	}
+	for k, v := range expected {
+		if record[k] != v {
+			t.Fatalf("%v: '%v' != '%v'", k, record[k], v)
+		}
+	}
+	if record["time"] == "" {
+		t.Fatal("record time expected")
+	}
+}
+
+func TestLoggerText(t *testing.T) {
+	var buf bytes.Buffer
+	l := &Logger{out: &buf, mu: &sync.Mutex{}}
+	if err := l.configure("text", "debug"); err != nil {
+		t.Fatal(err)
+	}
+
+	l.With("zone", "us-central1-a").Warnf("Retrying")
+	if !strings.HasSuffix(buf.String(), "WARNING: Retrying zone=us-central1-a\n") {
+		t.Fatalf("unexpected text record: %v", buf.String())
+	}
+
+	if err := l.configure("xml", "debug"); err == nil {
+		t.Fatal("invalid format error expected")
+	}
+	if err := l.configure("text", "verbose"); err == nil {
+		t.Fatal("invalid level error expected")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcloud-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "gcloud-ssh.log")
+	f, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"line-1\n", "line-2\n", "line-3\n", "line-4\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        "line-4\n",
+		path + ".1": "line-3\n",
+		path + ".2": "line-2\n",
+	}
+	for p, content := range expected {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Fatalf("%v: '%v' != '%v'", p, string(data), content)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatal("only 2 rotated files must be kept")
+	}
+}
+
+func TestRotatingFileProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcloud-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Each wrapper process has its own file
+	path := filepath.Join(dir, "gcloud-ssh.log")
+	first, err := openRotatingFile(path, 16, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := openRotatingFile(path, 16, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	for _, write := range []struct {
+		f    *rotatingFile
+		line string
+	}{
+		{first, "line-1\n"},
+		{first, "line-2\n"},
+		{second, "line-3\n"},
+		// The first one still has the rotated file open
+		{first, "line-4\n"},
+	} {
+		if _, err := write.f.Write([]byte(write.line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        "line-3\nline-4\n",
+		path + ".1": "line-1\nline-2\n",
+	}
+	for p, content := range expected {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Fatalf("%v: '%v' != '%v'", p, string(data), content)
+		}
+	}
+	if _, err := os.Stat(path + ".2"); !os.IsNotExist(err) {
+		t.Fatal("the file must be rotated once")
+	}
+}
@@ -9,121 +9,1267 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/oauth2/google"
 	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
 )
 
+// exitCodeFailure is the exit code used when the wrapper fails without a child
+// process exit code to propagate (lookup errors, gcloud not found, ...). It
+// mirrors ssh, which exits with 255 when an error occurs.
+const exitCodeFailure = 255
+
+// exitCodeConfig is the exit code used when the wrapper is not configured to
+// run, EX_CONFIG from sysexits.h
+const exitCodeConfig = 78
+
 var (
 	errorHasIdentityFile = errors.New("Has identity file")
+
+	// ErrInstanceNotFound is matched by the errors of the lookups that found
+	// no instance, see NotFoundError
+	ErrInstanceNotFound = errors.New("Instance not found")
+	// ErrInvalidDestination is returned for destinations that are neither an
+	// IP nor an instance name
+	ErrInvalidDestination = errors.New("Destination is not an IP, instance name or DNS name")
+	// ErrEmptyDestination and ErrEmptySource are returned when parsing
+	// ansible arguments missing them
+	ErrEmptyDestination = errors.New("Empty destination")
+	ErrEmptySource      = errors.New("Empty source")
+	// ErrProjectNotAllowed is returned for instances resolved in a project
+	// missing from GCLOUD_SSH_ALLOWED_PROJECTS
+	ErrProjectNotAllowed = errors.New("Project not allowed")
+
+	// instanceNameRegexp matches the RFC1035 names compute instances can have
+	instanceNameRegexp = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+)
+
+// Build metadata set by goreleaser with -ldflags "-X main.version=..."
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
 )
 
-// finds the project, zone and instance name that belongs to a networkIP
-func findInstance(computeService *compute.Service, projects, zones []string, networkIP string) (string, string, string, error) {
-	for _, project := range projects {
-		projectZones := zones
-		if len(projectZones) == 0 {
-			// If no zones are specified list all available zones
-			zoneListCall := computeService.Zones.List(project)
-			zoneList, err := zoneListCall.Do()
-			if err != nil {
-				return "", "", "", err
-			}
-			for _, zone := range zoneList.Items {
-				projectZones = append(projectZones, zone.Name)
-			}
+// retryBaseDelay is the delay before the first retry of a compute API call,
+// doubled on every following attempt
+var retryBaseDelay = 500 * time.Millisecond
+
+// checks if a compute API error is transient and the call can be retried
+func isRetryable(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.Code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// checks if the compute API call was refused, like a project the credentials
+// have no access to
+func isPermissionDenied(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden
+}
+
+// Gets a sleep between half and the full delay, so the forks of a run don't
+// retry in lockstep
+func jitter(delay time.Duration) time.Duration {
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// runs a compute API call retrying transient errors with exponential backoff
+// and jitter up to maxRetries times
+func withRetry(ctx context.Context, maxRetries int, call func() error) error {
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		err := call()
+		if err == nil || attempt >= maxRetries || !isRetryable(err) {
+			return err
+		}
+
+		sleep := jitter(delay)
+		logger.Warnf("Retrying compute API call in %v after error: %v", sleep, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sleep):
+		}
+		delay *= 2
+	}
+}
+
+// searchScope is a project, or a single zone of it, to search instances in
+type searchScope struct {
+	project string
+	zone    string
+}
+
+func (scope searchScope) String() string {
+	if scope.zone == "" {
+		return "project " + scope.project
+	}
+	return "zone " + scope.zone + " of project " + scope.project
+}
+
+// instanceMatch is an instance matching the searched instance
+type instanceMatch struct {
+	project  string
+	zone     string
+	instance string
+	// networkInterface is the name of the interface matched on instances
+	// with several ones, empty otherwise
+	networkInterface string
+	preemptible      bool
+	// id is the instance numeric ID its host keys are known by
+	id string
+}
+
+func newInstanceMatch(project, zone string, instance *compute.Instance, ni *compute.NetworkInterface) instanceMatch {
+	match := instanceMatch{project: project, zone: zone, instance: instance.Name}
+	match.preemptible = instance.Scheduling != nil && instance.Scheduling.Preemptible
+	if instance.Id != 0 {
+		match.id = strconv.FormatUint(instance.Id, 10)
+	}
+	if ni != nil && len(instance.NetworkInterfaces) > 1 {
+		match.networkInterface = ni.Name
+	}
+	return match
+}
+
+// searchResult is the search of a scope, matches are the instances matching
+// each of the queries searched
+type searchResult struct {
+	scope   searchScope
+	matches [][]instanceMatch
+	err     error
+}
+
+// NotFoundError is the error of a search that found no instance, it wraps the
+// errors of the searches that failed if any
+type NotFoundError struct {
+	// Query describes the searched instance, like "networkIP: 172.16.0.11"
+	Query string
+	Err   error
+}
+
+func (e *NotFoundError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("Not found %s: %v", e.Query, e.Err)
+	}
+	return "Not found " + e.Query
+}
+
+func (e *NotFoundError) Unwrap() error {
+	return e.Err
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrInstanceNotFound
+}
+
+// searchErrors aggregates the errors of the searches that failed
+type searchErrors []error
+
+func (e searchErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e searchErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e searchErrors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// instanceQuery describes the searched instance
+type instanceQuery struct {
+	// description of the searched instance for logs and errors
+	description string
+	// filter narrows the instances listed by the compute API
+	filter string
+	// match returns the network interface matched, nil when the instance
+	// matches as a whole
+	match func(instance *compute.Instance) (*compute.NetworkInterface, bool)
+	// networkIP is the IP searched, nil when searching by name
+	networkIP net.IP
+}
+
+// finds the project, zone and instance name that belongs to a networkIP
+func findInstance(ctx context.Context, computeService *compute.Service, cfg *Config, networkIP string) (string, string, string, error) {
+	match, err := searchInstance(ctx, computeService, cfg, addressQuery(cfg, networkIP))
+	return match.instance, match.zone, match.project, err
+}
+
+// finds the project and zone of an instance by its name
+func findInstanceByName(ctx context.Context, computeService *compute.Service, cfg *Config, instanceName string) (string, string, string, error) {
+	match, err := searchInstance(ctx, computeService, cfg, nameQuery(cfg, instanceName))
+	return match.instance, match.zone, match.project, err
+}
+
+// Builds the query of the instance a network IP or instance name belongs to
+func hostQuery(cfg *Config, host string) instanceQuery {
+	if parseIP(host) == nil {
+		return nameQuery(cfg, host)
+	}
+	return addressQuery(cfg, host)
+}
+
+// Builds the query of the instance that belongs to a networkIP. With a shared
+// VPC host project the networkIP must be on one of its networks as service
+// projects can reuse the same IP in their own VPCs.
+func addressQuery(cfg *Config, networkIP string) instanceQuery {
+	description := "networkIP: " + networkIP
+	if cfg.HostProject != "" {
+		description += " host project: " + cfg.HostProject
+	}
+	if cfg.Network != "" {
+		description += " network: " + cfg.Network
+	}
+	return instanceQuery{
+		description: description,
+		filter:      instanceFilter(cfg),
+		networkIP:   parseIP(networkIP),
+		match: func(instance *compute.Instance) (*compute.NetworkInterface, bool) {
+			for _, ni := range instance.NetworkInterfaces {
+				hasIP := interfaceHasIP(ni, networkIP) || (cfg.MatchExternal && interfaceHasExternalIP(ni, networkIP))
+				if hasIP && inHostProject(ni, cfg.HostProject) && inNetwork(ni, cfg.Network) {
+					return ni, true
+				}
+			}
+			return nil, false
+		},
+	}
+}
+
+// Builds the query of an instance by its name
+func nameQuery(cfg *Config, instanceName string) instanceQuery {
+	return instanceQuery{
+		description: "instance name: " + instanceName,
+		filter:      joinFilters(instanceFilter(cfg), fmt.Sprintf("(name = %s)", instanceName)),
+		match: func(instance *compute.Instance) (*compute.NetworkInterface, bool) {
+			return nil, instance.Name == instanceName
+		},
+	}
+}
+
+// Gets the instance statuses searched, the stopped instances are searched too
+// when they are started on demand
+func searchedStatuses(cfg *Config) []string {
+	statuses := cfg.StatusFilter
+	if len(statuses) == 0 {
+		statuses = []string{"RUNNING"}
+	}
+	if cfg.AutoStart {
+		statuses = append(statuses[:len(statuses):len(statuses)], "TERMINATED")
+	}
+	return statuses
+}
+
+// Builds the compute API filter expression of the instance statuses searched,
+// RUNNING when none and no filter at all for ALL
+func statusFilter(statuses []string) string {
+	expressions := []string{}
+	for _, status := range statuses {
+		status = strings.ToUpper(strings.TrimSpace(status))
+		if status == "ALL" {
+			return ""
+		}
+		if status != "" {
+			expressions = append(expressions, fmt.Sprintf("(status = %s)", status))
+		}
+	}
+	switch len(expressions) {
+	case 0:
+		return "(status = RUNNING)"
+	case 1:
+		return expressions[0]
+	}
+	return "(" + strings.Join(expressions, " OR ") + ")"
+}
+
+// Builds the compute API filter expression of the instances searched, by
+// status and label
+func instanceFilter(cfg *Config) string {
+	// The label and expression were validated with the config
+	label, _ := labelFilter(cfg.LabelFilter)
+	expression, _ := expressionFilter(cfg.InstanceFilter)
+	return joinFilters(statusFilter(searchedStatuses(cfg)), label, expression)
+}
+
+// Wraps a compute API filter expression in parentheses to AND it with the
+// other filters, after checking they are balanced. The expression syntax
+// itself is left to the API.
+func expressionFilter(expression string) (string, error) {
+	expression = strings.TrimSpace(expression)
+	if expression == "" {
+		return "", nil
+	}
+	depth := 0
+	var quote rune
+	for _, c := range expression {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		}
+		if depth < 0 {
+			break
+		}
+	}
+	if depth != 0 || quote != 0 {
+		return "", fmt.Errorf("Invalid instance filter %q, unbalanced parentheses or quotes", expression)
+	}
+	return "(" + expression + ")", nil
+}
+
+// Builds the compute API filter expression of a key=value label, no filter
+// when label is empty
+func labelFilter(label string) (string, error) {
+	if label == "" {
+		return "", nil
+	}
+	i := strings.Index(label, "=")
+	if i < 0 {
+		return "", fmt.Errorf("Invalid label filter %q, expected key=value", label)
+	}
+	key, value := strings.TrimSpace(label[:i]), strings.TrimSpace(label[i+1:])
+	if key == "" || value == "" {
+		return "", fmt.Errorf("Invalid label filter %q, expected key=value", label)
+	}
+	return fmt.Sprintf("(labels.%s = %s)", key, value), nil
+}
+
+// Joins the non empty compute API filter expressions
+func joinFilters(filters ...string) string {
+	expressions := []string{}
+	for _, filter := range filters {
+		if filter != "" {
+			expressions = append(expressions, filter)
+		}
+	}
+	return strings.Join(expressions, " AND ")
+}
+
+// finds the instance matching query searching up to cfg.Concurrency projects or zones at the same time. All the
+// scopes are searched as the same private IP can be reused in different
+// projects, when several instances match none of them is picked.
+func searchInstance(ctx context.Context, computeService *compute.Service, cfg *Config, query instanceQuery) (instanceMatch, error) {
+	query = withIAPTag(cfg, query)
+	start := time.Now()
+	scopes, err := searchScopes(ctx, computeService, cfg)
+	if err != nil {
+		return instanceMatch{}, err
+	}
+	if cfg.SubnetPrefilter && query.networkIP != nil {
+		scopes = prefilterScopes(ctx, computeService, cfg, scopes, query.networkIP)
+	}
+	logTiming(cfg, "zone listing", start)
+	defer logTiming(cfg, "instance listing", time.Now())
+	matches, errs := searchQueries(ctx, computeService, cfg, scopes, query.filter, []instanceQuery{query})
+	return pickMatch(query, matches[0], errs, len(scopes))
+}
+
+// Matches only the instances with the IAP network tag when cfg.RequireIAPTag
+// is set
+func withIAPTag(cfg *Config, query instanceQuery) instanceQuery {
+	if cfg.RequireIAPTag == "" {
+		return query
+	}
+	// Tunneling to an instance without the IAP firewall rule hangs
+	match := query.match
+	query.description += " tag: " + cfg.RequireIAPTag
+	query.match = func(instance *compute.Instance) (*compute.NetworkInterface, bool) {
+		if !hasTag(instance, cfg.RequireIAPTag) {
+			return nil, false
+		}
+		return match(instance)
+	}
+	return query
+}
+
+// Lists the instances matching filter in every scope, up to cfg.Concurrency
+// at the same time, and gets the instances matching each of the queries
+func searchQueries(ctx context.Context, computeService *compute.Service, cfg *Config, scopes []searchScope, filter string, queries []instanceQuery) ([][]instanceMatch, searchErrors) {
+	pending := make(chan searchScope, len(scopes))
+	for _, scope := range scopes {
+		pending <- scope
+	}
+	close(pending)
+
+	concurrency := cfg.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make(chan searchResult, len(scopes))
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency && i < len(scopes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for scope := range pending {
+				result := searchResult{scope: scope}
+				service, err := projectComputeService(cfg, computeService, scope.project)
+				if err == nil {
+					result.matches, err = findInstancesInScope(ctx, service, scope, filter, queries, cfg.MaxRetries, cfg.MaxScan)
+				}
+				result.err = err
+				results <- result
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var errs searchErrors
+	matches := make([][]instanceMatch, len(queries))
+	for result := range results {
+		if result.err != nil {
+			scopeLogger := logger.With("project", result.scope.project, "zone", result.scope.zone)
+			if isPermissionDenied(result.err) {
+				// The other projects may still have the instance
+				scopeLogger.Warnf("Skipping project: %s zone: %s without permission: %v", result.scope.project, result.scope.zone, result.err)
+			} else {
+				scopeLogger.Warnf("Search failed in project: %s zone: %s: %v", result.scope.project, result.scope.zone, result.err)
+			}
+			errs = append(errs, result.err)
+			continue
+		}
+		for i := range queries {
+			matches[i] = append(matches[i], result.matches[i]...)
+		}
+	}
+	return matches, errs
+}
+
+// Picks the single instance matching query in the scopes searched, with errs
+// the errors of the scopes that failed
+func pickMatch(query instanceQuery, matches []instanceMatch, errs searchErrors, scopes int) (instanceMatch, error) {
+	switch {
+	case len(matches) == 1:
+		return matches[0], nil
+	case len(matches) > 1:
+		return instanceMatch{}, ambiguousError(query, matches)
+	case len(errs) > 0 && len(errs) == scopes:
+		// Nothing was searched, the instance may exist
+		return instanceMatch{}, fmt.Errorf("Search of %s failed in every project: %w", query.description, errs)
+	case len(errs) > 0:
+		return instanceMatch{}, &NotFoundError{Query: query.description, Err: errs}
+	}
+	return instanceMatch{}, &NotFoundError{Query: query.description}
+}
+
+// Gets the projects, or zones of them, searched
+func searchScopes(ctx context.Context, computeService *compute.Service, cfg *Config) ([]searchScope, error) {
+	searched, err := searchedProjects(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	projects := []string{}
+	for _, project := range searched {
+		if !isProjectAllowed(cfg, project) {
+			logger.Warnf("Not searching project: %s missing from the allowed projects: %v", project, cfg.AllowedProjects)
+			continue
+		}
+		projects = append(projects, project)
+	}
+	zones := cfg.Zones
+	if len(cfg.Regions) > 0 && len(projects) > 0 {
+		// Regions have the same zones in every project, they are got from
+		// the first project allowing it
+		var err error
+		for _, project := range projects {
+			if zones, err = searchedZones(ctx, computeService, cfg, project); err == nil {
+				break
+			}
+			logger.Warnf("Cannot get the region zones in project: %s: %v", project, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	scopes := []searchScope{}
+	for _, project := range projects {
+		if len(zones) == 0 {
+			// If no zones are specified search all of them in a single call
+			scopes = append(scopes, searchScope{project: project})
+			continue
+		}
+		for _, zone := range zones {
+			scopes = append(scopes, searchScope{project: project, zone: zone})
+		}
+	}
+	return scopes, nil
+}
+
+// Builds the error listing every instance matching query
+func ambiguousError(query instanceQuery, matches []instanceMatch) error {
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].project != matches[j].project {
+			return matches[i].project < matches[j].project
+		}
+		if matches[i].zone != matches[j].zone {
+			return matches[i].zone < matches[j].zone
+		}
+		return matches[i].instance < matches[j].instance
+	})
+	candidates := make([]string, len(matches))
+	for i, match := range matches {
+		candidates[i] = fmt.Sprintf("project: %s zone: %s instance: %s", match.project, match.zone, match.instance)
+	}
+	return fmt.Errorf("Found %d instances with %s, narrow the search with GCLOUD_SSH_PROJECTS, GCLOUD_SSH_NETWORK or GCLOUD_SSH_LABEL_FILTER: %s", len(matches), query.description, strings.Join(candidates, "; "))
+}
+
+// finds the instances matching each of the queries in a project or a single
+// zone of it
+func findInstancesInScope(ctx context.Context, computeService *compute.Service, scope searchScope, filter string, queries []instanceQuery, maxRetries, maxScan int) ([][]instanceMatch, error) {
+	// Stops unfiltered listings of huge projects instead of scanning them for
+	// minutes once maxScan instances matched nothing, 0 has no limit
+	limit := func(instances []listedInstance) error {
+		if maxScan <= 0 || len(instances) <= maxScan {
+			return nil
+		}
+		for _, listed := range instances {
+			for _, query := range queries {
+				if _, ok := query.match(listed.instance); ok {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("Scanned %d instances of %s without a match, stopping at the GCLOUD_SSH_MAX_SCAN limit of %d", len(instances), scope, maxScan)
+	}
+	instances, err := listInstances(ctx, computeService, scope, filter, maxRetries, limit)
+	if err != nil {
+		return nil, err
+	}
+	logger.With("project", scope.project, "zone", scope.zone).Debugf("Scanned %d instances of %s", len(instances), scope)
+	matches := make([][]instanceMatch, len(queries))
+	for i, query := range queries {
+		for _, listed := range instances {
+			if ni, ok := query.match(listed.instance); ok {
+				matches[i] = append(matches[i], newInstanceMatch(scope.project, listed.zone, listed.instance, ni))
+			}
+		}
+		logMatches(query, matches[i])
+	}
+	return matches, nil
+}
+
+// listedInstance is an instance listed in a zone
+type listedInstance struct {
+	zone     string
+	instance *compute.Instance
+}
+
+// lists the instances of a single zone matching filter scanning every page
+// of the list, all the zones of the project are listed with aggregated list
+// calls when scope has no zone. The listing stops with the error of limit,
+// when not nil, called with the instances listed after each page.
+func listInstances(ctx context.Context, computeService *compute.Service, scope searchScope, filter string, maxRetries int, limit func([]listedInstance) error) ([]listedInstance, error) {
+	if limit == nil {
+		limit = func([]listedInstance) error { return nil }
+	}
+	var instances []listedInstance
+	if scope.zone != "" {
+		instanceListCall := computeService.Instances.List(scope.project, scope.zone)
+		if filter != "" {
+			instanceListCall.Filter(filter)
+		}
+		err := withRetry(ctx, maxRetries, func() error {
+			// A failed page restarts the listing from the first one
+			instances = nil
+			return instanceListCall.Pages(ctx, func(instanceList *compute.InstanceList) error {
+				for _, instance := range instanceList.Items {
+					instances = append(instances, listedInstance{zone: scope.zone, instance: instance})
+				}
+				return limit(instances)
+			})
+		})
+		return instances, err
+	}
+
+	aggregatedListCall := computeService.Instances.AggregatedList(scope.project)
+	if filter != "" {
+		aggregatedListCall.Filter(filter)
+	}
+	err := withRetry(ctx, maxRetries, func() error {
+		instances = nil
+		return aggregatedListCall.Pages(ctx, func(aggregatedList *compute.InstanceAggregatedList) error {
+			for key, scopedList := range aggregatedList.Items {
+				// Scopes are keyed as "zones/<zone name>"
+				zone := strings.TrimPrefix(key, "zones/")
+				for _, instance := range scopedList.Instances {
+					instances = append(instances, listedInstance{zone: zone, instance: instance})
+				}
+			}
+			return limit(instances)
+		})
+	})
+	return instances, err
+}
+
+func logMatches(query instanceQuery, matches []instanceMatch) {
+	for _, match := range matches {
+		logger.With("project", match.project, "zone", match.zone, "instance", match.instance).Infof("Found %s in zone: %s with name: %s", query.description, match.zone, match.instance)
+	}
+}
+
+// checks if the instance has the network tag
+func hasTag(instance *compute.Instance, tag string) bool {
+	if instance.Tags == nil {
+		return false
+	}
+	for _, item := range instance.Tags.Items {
+		if item == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// checks if a network interface has the networkIP
+func interfaceHasIP(ni *compute.NetworkInterface, networkIP string) bool {
+	// IPs are compared by value, 172.016.000.012 or ::ffff:172.16.0.12 are
+	// the network IP 172.16.0.12
+	if sameIP(networkIP, ni.NetworkIP) {
+		return true
+	}
+	ip := parseIP(networkIP)
+	if ip == nil {
+		return false
+	}
+	// Services can listen on the IPs of the interface alias ranges
+	for _, aliasRange := range ni.AliasIpRanges {
+		if _, ipNet, err := net.ParseCIDR(aliasRange.IpCidrRange); err == nil {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(aliasRange.IpCidrRange)) {
+			return true
+		}
+	}
+	if ip.To4() != nil {
+		return false
+	}
+	if ip.Equal(net.ParseIP(ni.Ipv6Address)) {
+		return true
+	}
+	for _, accessConfig := range ni.Ipv6AccessConfigs {
+		if ip.Equal(net.ParseIP(accessConfig.ExternalIpv6)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checks if a network interface has the external IPv4 ip
+func interfaceHasExternalIP(ni *compute.NetworkInterface, ip string) bool {
+	for _, accessConfig := range ni.AccessConfigs {
+		if accessConfig.NatIP != "" && sameIP(ip, accessConfig.NatIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// checks if the searched ip is the compute API one by value, or by text when
+// it is not an IP
+func sameIP(ip, apiIP string) bool {
+	parsed := parseIP(ip)
+	if parsed == nil {
+		return ip == apiIP
+	}
+	return parsed.Equal(net.ParseIP(apiIP))
+}
+
+// Parses an IP like net.ParseIP also accepting zero-padded IPv4 parts like
+// 172.016.000.012, read as decimal and not octal
+func parseIP(s string) net.IP {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return nil
+	}
+	for i, part := range parts {
+		if trimmed := strings.TrimLeft(part, "0"); trimmed != "" {
+			parts[i] = trimmed
+		} else if part != "" {
+			parts[i] = "0"
+		}
+	}
+	return net.ParseIP(strings.Join(parts, "."))
+}
+
+// checks if a network interface is attached to a network of hostProject, any
+// network matches when hostProject is empty
+func inHostProject(ni *compute.NetworkInterface, hostProject string) bool {
+	return hostProject == "" || selfLinkProject(ni.Network) == hostProject
+}
+
+// checks if a network interface is attached to network, a network name or
+// self-link, any network matches when network is empty
+func inNetwork(ni *compute.NetworkInterface, network string) bool {
+	if network == "" || ni.Network == network {
+		return true
+	}
+	if strings.Contains(network, "/") {
+		// Self-links are either full URLs or relative to the API
+		return strings.HasSuffix(ni.Network, "/"+strings.TrimPrefix(network, "/"))
+	}
+	return strings.HasSuffix(ni.Network, "/networks/"+network)
+}
+
+// Gets the project of a resource self-link like
+// https://www.googleapis.com/compute/v1/projects/<project>/global/networks/<network>
+func selfLinkProject(selfLink string) string {
+	parts := strings.Split(selfLink, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "projects" {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// Finds the path of a binary failing with a message pointing to the env var
+// used to configure it
+func findBinary(name, envKey string) (string, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("Cannot find %q, install it or set %s to its path: %w", name, envKey, err)
+	}
+	return path, nil
+}
+
+// Gets the ansible -o options passed through to ssh/scp. They are all
+// forwarded unless cfg.StripControl drops the Control* multiplexing ones, whose
+// ansible control socket the ssh run by gcloud may not find. With OS Login the
+// User option is dropped too, it would override the user gcloud logins as.
+func forwardedOptions(cfg *Config, options []string) []string {
+	if !cfg.StripControl && !cfg.OSLogin {
+		return options
+	}
+	forwarded := make([]string, 0, len(options))
+	for _, option := range options {
+		name := strings.SplitN(option, "=", 2)[0]
+		if cfg.StripControl && len(option) >= len("Control") && strings.EqualFold(option[:len("Control")], "Control") ||
+			cfg.OSLogin && strings.EqualFold(name, "User") {
+			logger.Debugf("Not forwarding the %s option", name)
+			continue
+		}
+		forwarded = append(forwarded, option)
+	}
+	return forwarded
+}
+
+// Builds the gcloud flags passing the ansible -o options through to ssh/scp.
+// Each option has its own flag so values with commas are never split, values
+// with spaces are quoted because gcloud splits the flags into words.
+func optionFlags(flag string, options []string) []string {
+	flags := make([]string, 0, len(options))
+	for _, option := range options {
+		if strings.ContainsAny(option, " \t") {
+			if i := strings.Index(option, "="); i > 0 {
+				option = option[:i+1] + strconv.Quote(option[i+1:])
+			}
+		}
+		flags = append(flags, flag+"=-o "+option)
+	}
+	return flags
+}
+
+const (
+	argState    = 1
+	startState  = 2
+	quotesState = 3
+)
+
+// ParseCommandLine splits a command line into its arguments, honoring quotes
+// and escapes. An unclosed quote is an error.
+func ParseCommandLine(command string) ([]string, error) {
+	return splitCommandLine(command, " \t")
+}
+
+// Splits a command line into its arguments separated by any of separators.
+// Like a shell word, an argument joins its quoted and unquoted parts.
+func splitCommandLine(command, separators string) ([]string, error) {
+	var args []string
+	var quote byte = '"'
+	state := startState
+	current := ""
+	escapeNext := false
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+
+		if state == quotesState {
+			if c != quote {
+				current += string(c)
+			} else {
+				// The argument goes on after the closing quote
+				state = argState
+			}
+			continue
+		}
+
+		if escapeNext {
+			current += string(c)
+			escapeNext = false
+			state = argState
+			continue
+		}
+
+		if c == '\\' {
+			escapeNext = true
+			continue
+		}
+
+		if c == '"' || c == '\'' {
+			state = quotesState
+			quote = c
+			continue
+		}
+
+		if strings.IndexByte(separators, c) >= 0 {
+			if state == argState {
+				args = append(args, current)
+				current = ""
+				state = startState
+			}
+			continue
+		}
+
+		state = argState
+		current += string(c)
+	}
+
+	if state == quotesState {
+		return []string{}, fmt.Errorf("Unclosed quote in command line: %s", command)
+	}
+
+	if state == argState {
+		args = append(args, current)
+	}
+
+	return args, nil
+}
+
+// Prefixes the ssh or scp target with the user to login as, if any
+func withUser(user, target string) string {
+	if user == "" || strings.Contains(target, "@") {
+		return target
+	}
+	return user + "@" + target
+}
+
+// Builds the gcloud flags connecting to the internal IP with cfg.InternalIP,
+// or to the interface with the network IP of a multi-NIC instance as gcloud
+// uses the first one otherwise. IAP tunnels already connect to the internal
+// IP and can't be combined with --internal-ip.
+func interfaceFlags(cfg *Config, ar AnsibleRun) []string {
+	flags := []string{}
+	if !cfg.UseIAP && (cfg.InternalIP || ar.NetworkInterface != "") {
+		flags = append(flags, "--internal-ip")
+	}
+	if ar.NetworkInterface != "" {
+		flags = append(flags, "--network-interface="+ar.NetworkInterface)
+	}
+	return flags
+}
+
+// Builds the gcloud flags coming before the command group
+func gcloudGlobalFlags(cfg *Config) []string {
+	if cfg.GcloudConfig == "" {
+		return []string{}
+	}
+	return []string{"--configuration", cfg.GcloudConfig}
+}
+
+// Builds the gcloud compute ssh arguments
+func gcloudSSHArgs(cfg *Config, ar AnsibleRun) []string {
+	args := append(gcloudGlobalFlags(cfg), "compute", "ssh")
+	if cfg.Quiet {
+		args = append(args, "--quiet")
+	}
+	if ar.Verbosity > 0 {
+		args = append(args, "--verbosity=debug")
+	}
+	if cfg.UseIAP {
+		args = append(args, "--tunnel-through-iap")
+	}
+	args = append(args, interfaceFlags(cfg, ar)...)
+	args = append(args, keyFileFlags(cfg, ar, "--ssh-flag")...)
+	args = append(args, optionFlags("--ssh-flag", forwardedOptions(cfg, ar.Options))...)
+	if ar.Port != "" {
+		args = append(args, "--ssh-flag=-p"+ar.Port)
+	}
+	if ar.ForwardAgent {
+		args = append(args, "--ssh-flag=-A")
+	}
+	for i := 0; i < ar.TTY; i++ {
+		args = append(args, "--ssh-flag=-t")
+	}
+	if ar.Quiet {
+		args = append(args, "--ssh-flag=-q")
+	}
+	if ar.Verbosity > 0 {
+		args = append(args, "--ssh-flag=-"+strings.Repeat("v", ar.Verbosity))
+	}
+	args = append(args, cfg.ExtraArgs...)
+	args = append(args,
+		"--project", ar.Project,
+		"--zone", ar.Zone, withUser(loginUser(cfg, ar), ar.Destination),
+	)
+	if command := ar.remoteCommand(); command != "" {
+		// Without a command gcloud just opens the session
+		args = append(args, "--command", command)
+	}
+	return args
+}
+
+// Gets the command line run by the remote shell. Several command arguments
+// are quoted so that they reach the shell as they were passed to ssh, a
+// single one is already a command line.
+func (ar AnsibleRun) remoteCommand() string {
+	if len(ar.CommandArgs) < 2 {
+		return ar.Command
+	}
+	quoted := make([]string, len(ar.CommandArgs))
+	for i, arg := range ar.CommandArgs {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Quotes the argument for a POSIX shell unless it has no special character
+func shellQuote(arg string) string {
+	if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%+=:,./_-") == "" {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// Builds the gcloud compute start-iap-tunnel arguments forwarding the stdio
+func gcloudTunnelArgs(cfg *Config, ar AnsibleRun) []string {
+	args := append(gcloudGlobalFlags(cfg), "compute", "start-iap-tunnel")
+	if cfg.Quiet {
+		args = append(args, "--quiet")
+	}
+	args = append(args, ar.Destination, ar.Port, "--listen-on-stdin")
+	if ar.NetworkInterface != "" {
+		args = append(args, "--network-interface="+ar.NetworkInterface)
+	}
+	return append(args, "--project", ar.Project, "--zone", ar.Zone)
+}
+
+// Builds the gcloud flags of the ssh key used instead of the
+// ~/.ssh/google_compute_engine default one, flag passes the ssh or scp flags
+func keyFileFlags(cfg *Config, ar AnsibleRun, flag string) []string {
+	if cfg.SkipKeyPropagation {
+		// gcloud neither checks nor uploads the key in plain mode, nor passes
+		// it to ssh. Neither does it pass its known hosts options, the host
+		// keys are still checked against its known hosts by instance ID.
+		home, _ := os.UserHomeDir()
+		keyFile := cfg.KeyFile
+		if keyFile == "" {
+			keyFile = filepath.Join(home, ".ssh", "google_compute_engine")
 		}
+		flags := []string{
+			"--plain",
+			flag + "=-i " + keyFile,
+			flag + "=-o UserKnownHostsFile=" + filepath.Join(home, ".ssh", "google_compute_known_hosts"),
+			flag + "=-o CheckHostIP=no",
+		}
+		if ar.InstanceID != "" {
+			flags = append(flags, flag+"=-o HostKeyAlias=compute."+ar.InstanceID)
+		}
+		return flags
+	}
+	if cfg.KeyFile == "" {
+		return nil
+	}
+	flags := []string{"--ssh-key-file", cfg.KeyFile}
+	if cfg.ForceKeyFileOverwrite {
+		// Regenerates the key when its public or private file is missing
+		flags = append(flags, "--force-key-file-overwrite")
+	}
+	return flags
+}
 
-		for _, zone := range projectZones {
-			instanceListCall := computeService.Instances.List(project, zone)
-			instanceListCall.Filter("(status = RUNNING)")
-			instanceList, err := instanceListCall.Do()
-			if err != nil {
-				return "", "", "", err
-			}
+// Builds the gcloud compute scp arguments
+func gcloudSCPArgs(cfg *Config, ar AnsibleRun) []string {
+	args := append(gcloudGlobalFlags(cfg), "compute", "scp")
+	if cfg.Quiet {
+		args = append(args, "--quiet")
+	}
+	if cfg.UseIAP {
+		args = append(args, "--tunnel-through-iap")
+	}
+	if ar.Recursive {
+		args = append(args, "--recurse")
+	}
+	args = append(args, interfaceFlags(cfg, ar)...)
+	args = append(args, keyFileFlags(cfg, ar, "--scp-flag")...)
+	args = append(args, optionFlags("--scp-flag", forwardedOptions(cfg, ar.Options))...)
+	if ar.Port != "" {
+		args = append(args, "--scp-flag=-P"+ar.Port)
+	}
+	if ar.Limit != "" {
+		args = append(args, "--scp-flag=-l"+ar.Limit)
+	}
+	if ar.Compress {
+		args = append(args, "--scp-flag=-C")
+	}
+	args = append(args, cfg.ExtraArgs...)
+	args = append(args, "--project", ar.Project, "--zone", ar.Zone)
+	if !ar.Download {
+		args = append(args, ar.Sources...)
+		return append(args, withUser(loginUser(cfg, ar), ar.Destination))
+	}
+	for _, source := range ar.Sources {
+		args = append(args, withUser(loginUser(cfg, ar), source))
+	}
+	return append(args, ar.Destination)
+}
 
-			for _, instance := range instanceList.Items {
-				for _, ni := range instance.NetworkInterfaces {
-					if ni.NetworkIP == networkIP {
-						log.Printf("Found network IP: %s in zone: %s with name: %s", networkIP, zone, instance.Name)
-						return instance.Name, zone, project, nil
-					}
-				}
-			}
+func runGCloudSSH(cfg *Config, ar AnsibleRun) error {
+	gcloud, err := findBinary(cfg.GcloudPath, "GCLOUD_SSH_GCLOUD_BIN")
+	if err != nil {
+		return err
+	}
+	checkOSLoginUser(cfg, ar)
+	args := gcloudSSHArgs(cfg, ar)
+	if strings.TrimSpace(cfg.SSHTemplate) != "" {
+		if args, err = renderArgs(cfg.SSHTemplate, sshTemplateData(cfg, ar)); err != nil {
+			return fmt.Errorf("Cannot render GCLOUD_SSH_SSH_TEMPLATE: %w", err)
 		}
 	}
+	return runGCloudKeyed(cfg, gcloud, args)
+}
+
+// fingerprintRetries is the number of times a gcloud ssh or scp run failing
+// on a concurrent ssh key metadata update is retried
+const fingerprintRetries = 3
+
+// Runs gcloud ssh or scp, again when it failed to add the ssh key because
+// other forks updated the metadata at the same time. Nothing ran on the
+// instance yet, so only those failures are retried.
+func runGCloudKeyed(cfg *Config, gcloud string, args []string) error {
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		// The stderr end tells the cause of the failures
+		stderr := &tailBuffer{max: 64 * 1024}
+		err := runner(gcloud, args, stderr, cfg.CommandTimeout)
+		if err == nil || attempt >= fingerprintRetries || isStopped(err) || !fingerprintConflict.MatchString(stderr.String()) {
+			return withHint(err, stderr.String())
+		}
 
-	return "", "", "", fmt.Errorf("Not found networkIP: %v", networkIP)
+		sleep := jitter(delay)
+		logger.Warnf("Retrying gcloud in %v after a concurrent ssh key metadata update: %v", sleep, err)
+		time.Sleep(sleep)
+		delay *= 2
+	}
 }
 
-func runGCloudSSH(ar AnsibleRun) error {
-	cmd := exec.Command("gcloud",
-		"compute",
-		"ssh",
-		"--quiet",
-		"--tunnel-through-iap",
-		"--project", ar.Project,
-		"--zone", ar.Zone, ar.Destination,
-		"--command", ar.Command,
-	)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+// Forwards the stdio to the port of the resolved instance through an IAP
+// tunnel, like ssh -W does through the destination
+func runGCloudTunnel(cfg *Config, ar AnsibleRun) error {
+	if !cfg.UseIAP {
+		return fmt.Errorf("Forwarding to %s with -W needs the IAP tunnel, GCLOUD_SSH_USE_IAP is disabled", ar.Forward)
+	}
+	gcloud, err := findBinary(cfg.GcloudPath, "GCLOUD_SSH_GCLOUD_BIN")
+	if err != nil {
+		return err
+	}
+	stderr := &tailBuffer{max: 64 * 1024}
+	return withHint(runner(gcloud, gcloudTunnelArgs(cfg, ar), stderr, cfg.CommandTimeout), stderr.String())
 }
 
-func runGCloudSCP(ar AnsibleRun) error {
-	cmd := exec.Command("gcloud",
-		"compute",
-		"scp",
-		"--quiet",
-		"--tunnel-through-iap",
-		"--project", ar.Project,
-		"--zone", ar.Zone, ar.Source, ar.Destination,
-	)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+func runGCloudSCP(cfg *Config, ar AnsibleRun) error {
+	gcloud, err := findBinary(cfg.GcloudPath, "GCLOUD_SSH_GCLOUD_BIN")
+	if err != nil {
+		return err
+	}
+	checkOSLoginUser(cfg, ar)
+	args := gcloudSCPArgs(cfg, ar)
+	if strings.TrimSpace(cfg.SCPTemplate) != "" {
+		if args, err = renderArgs(cfg.SCPTemplate, scpTemplateData(cfg, ar)); err != nil {
+			return fmt.Errorf("Cannot render GCLOUD_SSH_SCP_TEMPLATE: %w", err)
+		}
+	}
+	return runGCloudKeyed(cfg, gcloud, args)
+}
+
+func runSystemSSH(cfg *Config, args []string) error {
+	logger.Infof("Running %s with args: %v", cfg.SystemSSHPath, redactArgs(args, "-l"))
+	systemSSH, err := findBinary(cfg.SystemSSHPath, "GCLOUD_SSH_SYSTEM_SSH")
+	if err != nil {
+		return err
+	}
+	return runner(systemSSH, args, nil, 0)
 }
 
-func runSystemSCP(args []string) error {
-	log.Println("Running system-scp with args:", args)
-	cmd := exec.Command("system-scp", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+func runSystemSCP(cfg *Config, args []string) error {
+	logger.Infof("Running %s with args: %v", cfg.SystemSCPPath, redactArgs(args, ""))
+	systemSCP, err := findBinary(cfg.SystemSCPPath, "GCLOUD_SSH_SYSTEM_SCP")
+	if err != nil {
+		return err
+	}
+	return runner(systemSCP, args, nil, 0)
 }
 
 type AnsibleRun struct {
-	Command     string
-	Source      string
+	Command string
+	// CommandArgs are the command arguments passed after the destination,
+	// Command joins them with spaces unless -c gave it
+	CommandArgs []string
+	// Sources are the scp sources copied to Destination
+	Sources     []string
 	Destination string
 	Zone        string
 	Project     string
+	// Host is the network IP or instance name resolved
+	Host      string
+	Recursive bool
+	// Port is the ssh port set with -p, -P or a [ip]:port ssh destination
+	Port string
+	// Download is set when the scp sources are the remote side
+	Download bool
+	// NetworkInterface is the interface of the resolved instance with the
+	// network IP, when the instance has several ones
+	NetworkInterface string
+	// Preemptible is set when the resolved instance is preemptible
+	Preemptible bool
+	// InstanceID is the numeric ID of the resolved instance, when known
+	InstanceID string
+	// ForwardAgent is set by -A and TTY counts the -t, -tt forcing the tty
+	// allocation even when ssh has no tty
+	ForwardAgent bool
+	TTY          int
+	// Quiet is set by -q and Verbosity counts the -v, -vvv
+	Quiet     bool
+	Verbosity int
+	// Forward is the -W host:port the stdio is forwarded to, through the
+	// destination with ssh
+	Forward string
+	// Limit is the scp -l bandwidth limit in Kbit/s and Compress its -C
+	// compression
+	Limit    string
+	Compress bool
 
 	Options []string
 }
 
+// Copies the run, the targets are resolved in place
+func (ar AnsibleRun) clone() AnsibleRun {
+	ar.Sources = append([]string(nil), ar.Sources...)
+	ar.Options = append([]string(nil), ar.Options...)
+	ar.CommandArgs = append([]string(nil), ar.CommandArgs...)
+	return ar
+}
+
+// User returns the login user set with -o User=, gcloud logins with its own
+// default user otherwise
+func (ar AnsibleRun) User() string {
+	for _, option := range ar.Options {
+		if i := strings.Index(option, "="); i > 0 && strings.EqualFold(option[:i], "User") {
+			return strings.Trim(option[i+1:], `"'`)
+		}
+	}
+	return ""
+}
+
 func ParseAnsibleArgs(args []string) (AnsibleRun, error) {
 	result := AnsibleRun{}
-	commands := []string{}
 	for i := 1; i < len(args); i++ {
 		arg := args[i]
-		switch arg {
-		case "-c":
-			i++
-			result.Command = args[i]
+		// Like ssh, the arguments from the command on are all the command
+		if len(result.CommandArgs) > 0 {
+			result.CommandArgs = append(result.CommandArgs, arg)
 			continue
-		case "-o":
+		}
+		switch arg {
+		case "-c", "-o", "-p", "-W":
+			if i+1 == len(args) {
+				return result, fmt.Errorf("Missing value of ssh flag %s", arg)
+			}
 			i++
-			result.Options = append(result.Options, args[i])
+			switch arg {
+			case "-c":
+				result.Command = args[i]
+			case "-o":
+				result.Options = append(result.Options, args[i])
+			case "-p":
+				result.Port = args[i]
+			case "-W":
+				result.Forward = args[i]
+			}
 			continue
 		default:
-			if arg[0] == '-' {
+			if strings.HasPrefix(arg, "-p") {
+				result.Port = arg[2:]
+				continue
+			}
+			if strings.HasPrefix(arg, "-W") {
+				result.Forward = arg[2:]
+				continue
+			}
+			if isFlagGroup(arg, "Atqv") {
+				// Like -A, -tt and -vvv, possibly grouped as -At
+				result.ForwardAgent = result.ForwardAgent || strings.Contains(arg, "A")
+				result.TTY += strings.Count(arg, "t")
+				result.Quiet = result.Quiet || strings.Contains(arg, "q")
+				result.Verbosity += strings.Count(arg, "v")
+				continue
+			}
+			if strings.HasPrefix(arg, "-") {
 				continue
 			}
 		}
@@ -131,23 +1277,42 @@ func ParseAnsibleArgs(args []string) (AnsibleRun, error) {
 		if result.Destination == "" {
 			result.Destination = arg
 		} else {
-			commands = append(commands, arg)
+			result.CommandArgs = append(result.CommandArgs, arg)
 		}
 	}
 
 	if result.Destination == "" {
-		return result, fmt.Errorf("Empty destination")
+		return result, ErrEmptyDestination
 	}
-	if result.Command == "" {
-		result.Command = strings.Join(commands, " ")
+	// A ssh destination has no path, a number after the brackets is the port
+	if i := strings.LastIndex(result.Destination, "]:"); i > 0 {
+		if port := result.Destination[i+2:]; isPort(port) {
+			result.Destination, result.Port = result.Destination[:i+1], port
+		}
 	}
 	if result.Command == "" {
-		return result, fmt.Errorf("Empty command")
+		result.Command = strings.Join(result.CommandArgs, " ")
+	} else if len(result.CommandArgs) > 0 {
+		// The -c command is run instead
+		logger.Debugf("Ignoring the command arguments: %q", result.CommandArgs)
+		result.CommandArgs = nil
+	}
+	// Forwarding stdio to the target runs no command, and neither do the
+	// connection probes like ssh connecting without one
+	if result.Forward != "" {
+		if _, _, err := net.SplitHostPort(result.Forward); err != nil {
+			return result, fmt.Errorf("Invalid -W forwarding: %w", err)
+		}
 	}
-	log.Printf("Parsed ansible ssh: %#+v", result)
+	logger.Debugf("Parsed ansible ssh: %#+v", result.redacted())
 	return result, nil
 }
 
+// checks if the argument only groups flags without value among flags
+func isFlagGroup(arg, flags string) bool {
+	return len(arg) > 1 && arg[0] == '-' && strings.Trim(arg[1:], flags) == ""
+}
+
 func ParseAnsibleSCP(args []string) (AnsibleRun, error) {
 	result := AnsibleRun{}
 	for i := 1; i < len(args); i++ {
@@ -155,79 +1320,399 @@ func ParseAnsibleSCP(args []string) (AnsibleRun, error) {
 		switch arg {
 		case "-i":
 			return result, errorHasIdentityFile
-		case "-o":
+		case "-r":
+			result.Recursive = true
+			continue
+		case "-C":
+			result.Compress = true
+			continue
+		case "-o", "-P", "-l":
+			if i+1 == len(args) {
+				return result, fmt.Errorf("Missing value of scp flag %s", arg)
+			}
 			i++
-			result.Options = append(result.Options, args[i])
+			switch arg {
+			case "-o":
+				result.Options = append(result.Options, args[i])
+			case "-P":
+				result.Port = args[i]
+			case "-l":
+				result.Limit = args[i]
+			}
 			continue
 		default:
-			if arg[0] == '-' {
+			if strings.HasPrefix(arg, "-P") {
+				result.Port = arg[2:]
+				continue
+			}
+			if strings.HasPrefix(arg, "-l") {
+				result.Limit = arg[2:]
+				continue
+			}
+			if strings.HasPrefix(arg, "-") {
 				continue
 			}
 		}
-		if result.Source == "" {
-			result.Source = arg
-			continue
+		// The last argument is the destination, all the others are sources
+		if result.Destination != "" {
+			result.Sources = append(result.Sources, result.Destination)
 		}
 		result.Destination = arg
 	}
 
 	if result.Destination == "" {
-		return result, fmt.Errorf("Empty destination")
+		return result, ErrEmptyDestination
 	}
-	if result.Source == "" {
-		return result, fmt.Errorf("Empty source")
+	if len(result.Sources) == 0 {
+		return result, ErrEmptySource
 	}
-	log.Printf("Parsed ansible scp: %#+v", result)
+	result.Download = isRemote(result.Sources[0])
+	logger.Debugf("Parsed ansible scp: %#+v", result.redacted())
 	return result, nil
 }
 
+// Checks if a ssh destination suffix is a port number
+func isPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
+
+// Checks if a scp argument is a remote [ip]:path target, or host:path with
+// an IP, instance name or DNS name host
+func isRemote(target string) bool {
+	_, target = splitUser(target)
+	if strings.Index(target, "[") == 0 {
+		return true
+	}
+	i := strings.Index(target, ":")
+	if i <= 0 {
+		return false
+	}
+	host := target[:i]
+	return parseIP(host) != nil || isInstanceName(host) || isDNSName(host)
+}
+
+// Splits the user@ prefix of a ssh or scp target, slashes and colons are not
+// allowed in users so paths with an @ are not split
+func splitUser(target string) (string, string) {
+	if i := strings.Index(target, "@"); i > 0 && !strings.ContainsAny(target[:i], ":[/") {
+		return target[:i], target[i+1:]
+	}
+	return "", target
+}
+
+// Extracts the host of a ssh destination or scp target, without the user@
+// prefix and the :path suffix
 func ExtractIP(str string) string {
-	// SCP destination is [xxx]:yyy
-	parts := strings.Split(str, ":")
-	wrapped := parts[0]
-	if strings.Index(wrapped, "[") == 0 {
-		return wrapped[1 : len(wrapped)-1]
+	_, str = splitUser(str)
+	host, _ := splitHost(str)
+	return host
+}
+
+// Splits a target without user@ prefix into its host and the rest, the
+// :path of scp or the :port of a bracketed ssh destination. Only the first
+// colon after the host separates them, the path may have others.
+func splitHost(target string) (string, string) {
+	// SCP destination is [xxx]:yyy, the brackets are mandatory for IPv6
+	if strings.Index(target, "[") == 0 {
+		if end := strings.Index(target, "]"); end > 0 {
+			return target[1:end], target[end+1:]
+		}
 	}
-	return parts[0]
+	// ssh destinations have no path, an IPv6 may be passed without brackets
+	if strings.Count(target, ":") > 1 && parseIP(target) != nil {
+		return target, ""
+	}
+	if i := strings.Index(target, ":"); i >= 0 {
+		return target[:i], target[i:]
+	}
+	return target, ""
 }
 
-func updateWithInstanceName(projects, zones []string, ansible *AnsibleRun) error {
-	ctx := context.Background()
-	client, err := google.DefaultClient(ctx, compute.ComputeScope)
+func updateWithInstanceName(ctx context.Context, cfg *Config, cache *resolutionCache, ansible *AnsibleRun) error {
+	// The remote side is the destination unless scp is downloading files
+	targets := []*string{&ansible.Destination}
+	if ansible.Download {
+		targets = targets[:0]
+		for i := range ansible.Sources {
+			targets = append(targets, &ansible.Sources[i])
+		}
+	}
+	host := ExtractIP(*targets[0])
+	if parseIP(host) == nil && !isInstanceName(host) && !isDNSName(host) {
+		// Avoid searching every project and zone for something never found
+		return fmt.Errorf("%w: %q", ErrInvalidDestination, host)
+	}
+	for _, target := range targets[1:] {
+		if ExtractIP(*target) != host {
+			return fmt.Errorf("Sources on different hosts: %q and %q", *targets[0], *target)
+		}
+	}
+
+	var entry cacheEntry
+	var err error
+	if cfg.Zone != "" && cfg.Project != "" {
+		entry, err = lookupInZone(ctx, cfg, host)
+	} else {
+		entry, err = lookupInstance(ctx, cfg, cache, host)
+	}
 	if err != nil {
 		return err
 	}
+	// Cached and daemon resolutions may come from a less restricted config
+	if !isProjectAllowed(cfg, entry.Project) {
+		return fmt.Errorf("%w: %s resolved %s in project %s", ErrProjectNotAllowed, host, entry.Instance, entry.Project)
+	}
+
+	for _, target := range targets {
+		*target = replaceIP(*target, host, entry.Instance)
+	}
+	ansible.Host = host
+	ansible.Zone = entry.Zone
+	ansible.Project = entry.Project
+	ansible.NetworkInterface = entry.Interface
+	ansible.Preemptible = entry.Preemptible
+	ansible.InstanceID = entry.ID
+	logger.With("project", entry.Project, "zone", entry.Zone, "instance", entry.Instance, "host", host).Debugf("Resolved destination: %s", *targets[0])
+
+	return nil
+}
+
+// Resolves host in the zone and project the operator set with GCLOUD_SSH_ZONE
+// and GCLOUD_SSH_PROJECT. Instance names are connected to without calling the
+// compute API, the other hosts are only searched in that zone.
+func lookupInZone(ctx context.Context, cfg *Config, host string) (cacheEntry, error) {
+	if isInstanceName(host) {
+		logger.With("project", cfg.Project, "zone", cfg.Zone, "instance", host).Infof("Using instance: %s in zone: %s of project: %s", host, cfg.Zone, cfg.Project)
+		return cacheEntry{Instance: host, Zone: cfg.Zone, Project: cfg.Project}, nil
+	}
+	// The cache and daemon may have resolved host in another zone
+	return lookupInstance(ctx, zoneConfig(cfg), nil, host)
+}
+
+// Gets the config only searching the GCLOUD_SSH_ZONE zone of the
+// GCLOUD_SSH_PROJECT project, without asking the daemon
+func zoneConfig(cfg *Config) *Config {
+	scoped := *cfg
+	scoped.Projects, scoped.Folder, scoped.Zones, scoped.Regions = []string{cfg.Project}, "", []string{cfg.Zone}, nil
+	scoped.Zone, scoped.Project, scoped.Socket = "", "", ""
+	return &scoped
+}
+
+// Replaces the networkIP of a ssh or scp target with the instance name,
+// keeping the user@ prefix if any
+func replaceIP(target, networkIP, instanceName string) string {
+	user, target := splitUser(target)
+	// The path keeps the IP it may have
+	if host, rest := splitHost(target); host == networkIP {
+		target = instanceName + rest
+	}
+	if user != "" {
+		return user + "@" + target
+	}
+	return target
+}
+
+// Checks if project is in cfg.AllowedProjects, every project is allowed when
+// the list is empty
+func isProjectAllowed(cfg *Config, project string) bool {
+	if len(cfg.AllowedProjects) == 0 {
+		return true
+	}
+	for _, allowed := range cfg.AllowedProjects {
+		if allowed == project {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if host is a valid compute instance name
+func isInstanceName(host string) bool {
+	return instanceNameRegexp.MatchString(host)
+}
+
+// finds the project, zone and instance name of a host, a network IP, an
+// instance name or a DNS name, in the cache or searching the compute API when not cached
+func lookupInstance(ctx context.Context, cfg *Config, cache *resolutionCache, host string) (cacheEntry, error) {
+	if isDNSName(host) {
+		return lookupDNSName(ctx, cfg, cache, host)
+	}
+	if entry, ok := cache.Get(host); ok {
+		logger.With("project", entry.Project, "zone", entry.Zone, "instance", entry.Instance, "host", host).Infof("Found cached host: %s in zone: %s with name: %s", host, entry.Zone, entry.Instance)
+		stats.Incr("gcloud_ssh.resolve.hit", "source:cache")
+		return entry, nil
+	}
 
-	networkIP := ExtractIP(ansible.Destination)
+	if cfg.Socket != "" {
+		entry, err := resolveWithDaemon(cfg.Socket, resolveRequest{Host: host, Refresh: cfg.refresh}, cfg.Timeout)
+		if err == nil {
+			logger.With("project", entry.Project, "zone", entry.Zone, "instance", entry.Instance, "host", host).Infof("Resolved host: %s by the daemon in zone: %s with name: %s", host, entry.Zone, entry.Instance)
+			cache.Put(host, entry)
+			return entry, nil
+		}
+		if !errors.Is(err, errorDaemonUnavailable) {
+			return cacheEntry{}, err
+		}
+		logger.Debugf("Searching the compute API: %v", err)
+	}
 
-	computeService, err := compute.New(client)
+	computeService, err := getComputeService(cfg)
 	if err != nil {
-		return err
+		return cacheEntry{}, err
 	}
-	instanceName, zone, project, err := findInstance(computeService, projects, zones, networkIP)
+	start := time.Now()
+	match, err := searchInstance(ctx, computeService, cfg, hostQuery(cfg, host))
+	stats.Timing("gcloud_ssh.resolve.duration", time.Since(start))
 	if err != nil {
-		return err
+		stats.Incr("gcloud_ssh.resolve.miss", "source:api")
+		return cacheEntry{}, err
 	}
+	stats.Incr("gcloud_ssh.resolve.hit", "source:api")
 
-	if strings.Index(ansible.Destination, "[") == 0 {
-		ansible.Destination = strings.Replace(ansible.Destination, "["+networkIP+"]", instanceName, -1)
-	} else {
-		ansible.Destination = strings.Replace(ansible.Destination, networkIP, instanceName, -1)
+	if computeService, err = projectComputeService(cfg, computeService, match.project); err != nil {
+		return cacheEntry{}, err
+	}
+	switch {
+	case cfg.readOnly:
+	case cfg.AutoStart:
+		err = startInstance(computeService, cfg, match.project, match.zone, match.instance)
+	case cfg.BootWait > 0:
+		err = waitForBoot(computeService, cfg, match.project, match.zone, match.instance)
+	}
+	if err != nil {
+		return cacheEntry{}, err
 	}
-	ansible.Zone = zone
-	ansible.Project = project
 
-	return nil
+	entry := cacheEntry{Instance: match.instance, Zone: match.zone, Project: match.project, Interface: match.networkInterface, Preemptible: match.preemptible, ID: match.id}
+	cache.Put(host, entry)
+	return entry, nil
+}
+
+// impersonatedTokenSource creates the token source of an impersonated service
+// account, replaced in tests
+var impersonatedTokenSource = impersonate.CredentialsTokenSource
+
+// Builds the compute API client options, the default credentials or the
+// cfg.CredentialsFile ones are used unless the lookup impersonates
+// cfg.ImpersonateSA
+func computeClientOptions(ctx context.Context, cfg *Config) ([]option.ClientOption, error) {
+	// Audit logs tell the wrapper release listing the instances
+	opts := []option.ClientOption{option.WithUserAgent("gcloud-ssh/" + version)}
+	scope := cfg.ComputeScope
+	if cfg.AutoStart && !cfg.readOnly && scope == compute.ComputeReadonlyScope {
+		// Starting instances needs the read-write scope
+		scope = compute.ComputeScope
+	}
+	credentials, err := credentialOptions(ctx, cfg, scope)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, credentials...)
+	if cfg.ComputeEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(cfg.ComputeEndpoint))
+	}
+	if cfg.QuotaProject != "" {
+		// Bill the lookups to a project instead of the credentials one
+		opts = append(opts, option.WithQuotaProject(cfg.QuotaProject))
+	}
+	return opts, nil
+}
+
+// Builds the credentials options of the API clients requesting scope
+func credentialOptions(ctx context.Context, cfg *Config, scope string) ([]option.ClientOption, error) {
+	var credentials []option.ClientOption
+	if cfg.CredentialsFile != "" {
+		credentials = append(credentials, option.WithCredentialsFile(cfg.CredentialsFile))
+	}
+	if cfg.ImpersonateSA == "" {
+		return append(credentials, option.WithScopes(scope)), nil
+	}
+	// The credentials file is the identity impersonating the account
+	tokenSource, err := impersonatedTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: cfg.ImpersonateSA,
+		Scopes:          []string{scope},
+	}, credentials...)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot impersonate %s: %w", cfg.ImpersonateSA, err)
+	}
+	return []option.ClientOption{option.WithTokenSource(tokenSource)}, nil
+}
+
+var (
+	// buildComputeService creates the shared compute API client, replaced in
+	// tests
+	buildComputeService = newComputeService
+
+	computeServiceOnce   sync.Once
+	sharedComputeService *compute.Service
+	computeServiceErr    error
+)
+
+// Gets the compute API client shared by all the lookups of the process, it is
+// created on first use
+func getComputeService(cfg *Config) (*compute.Service, error) {
+	computeServiceOnce.Do(func() {
+		defer logTiming(cfg, "credentials", time.Now())
+		// The client outlives the deadline of the lookup creating it
+		sharedComputeService, computeServiceErr = buildComputeService(context.Background(), cfg)
+	})
+	return sharedComputeService, computeServiceErr
+}
+
+// Creates the compute API client used by the lookups
+func newComputeService(ctx context.Context, cfg *Config) (*compute.Service, error) {
+	opts, err := computeClientOptions(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return compute.NewService(ctx, opts...)
+}
+
+// Finds the credentials of the compute API lookup, read from
+// cfg.CredentialsFile or the application default ones when empty
+func findCredentials(ctx context.Context, cfg *Config) (*google.Credentials, error) {
+	if cfg.CredentialsFile == "" {
+		return google.FindDefaultCredentials(ctx, cfg.ComputeScope)
+	}
+	data, err := ioutil.ReadFile(cfg.CredentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read credentials file: %w", err)
+	}
+	return google.CredentialsFromJSON(ctx, data, cfg.ComputeScope)
+}
+
+// Gets the project of the lookup credentials, searched when no project is
+// configured
+func defaultProject(ctx context.Context, cfg *Config) (string, error) {
+	credentials, err := findCredentials(ctx, cfg)
+	if err != nil {
+		return "", fmt.Errorf("Cannot find the projects to search, set GCLOUD_SSH_PROJECTS or configure the application default credentials with gcloud auth application-default login: %w", err)
+	}
+	if credentials.ProjectID == "" {
+		// User credentials have no project
+		return "", errors.New("Cannot find the projects to search, set GCLOUD_SSH_PROJECTS as the credentials have no project")
+	}
+	return credentials.ProjectID, nil
 }
 
-func setupLogger() func() {
-	f, err := os.OpenFile("/var/log/gcloud-ssh.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+// Logs to the rotated cfg.LogFile, or to stderr when it is empty or the file
+// can't be opened so the wrapper still runs without a writable log
+func setupLogger(cfg *Config) func() {
+	log.SetOutput(os.Stderr)
+	if cfg.LogFile == "" {
+		return func() {}
+	}
+	f, err := openRotatingFile(cfg.LogFile, int64(cfg.LogMaxBytes), cfg.LogMaxFiles)
 	if err != nil {
-		log.Fatal(err)
+		logger.Warnf("Logging to stderr, cannot open log file: %v", err)
+		return func() {}
 	}
 	log.SetOutput(f)
 
 	return func() {
+		log.SetOutput(os.Stderr)
+		f.Sync()
 		f.Close()
 	}
 }
@@ -240,69 +1725,263 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-// Get env var or default
+// Get comma separated env var or default, the values are trimmed and the
+// empty ones dropped
 func getEnvList(key string, fallback []string) []string {
-	if value, ok := os.LookupEnv(key); ok {
-		if value != "" {
-			return strings.Split(value, ",")
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	values := []string{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
 		}
 	}
-	return fallback
+	if len(values) == 0 {
+		return fallback
+	}
+	return values
+}
+
+// checks if the destination is not a compute instance, the original ssh or
+// scp can then connect to it directly
+func isUnresolved(err error) bool {
+	return errors.Is(err, ErrInstanceNotFound) || errors.Is(err, ErrInvalidDestination)
 }
 
-func parseAndRun(doSCP bool, projects, zones []string) error {
-	if doSCP {
+func parseAndRun(ctx context.Context, cfg *Config, cache *resolutionCache) error {
+	defer logTiming(cfg, "total", time.Now())
+	if cfg.DoSCP {
 		// Check if we have to run system's scp command
 		ansible, err := ParseAnsibleSCP(os.Args)
 		if err != nil {
 			if err == errorHasIdentityFile {
-				err = runSystemSCP(os.Args[1:])
+				err = runSystemSCP(cfg, os.Args[1:])
 			}
 			return err
 		}
 
 		// Running Cloud SCP
-		err = updateWithInstanceName(projects, zones, &ansible)
-		if err != nil {
-			return err
-		}
-		runGCloudSCP(ansible)
-	} else {
-		ansible, err := ParseAnsibleArgs(os.Args)
+		unresolved := ansible.clone()
+		err = updateWithInstanceName(ctx, cfg, cache, &ansible)
 		if err != nil {
+			if cfg.FallbackDirect && isUnresolved(err) {
+				logger.Warnf("Instance resolution failed, falling back to system-scp to the original destination: %v", err)
+				return runSystemSCP(cfg, os.Args[1:])
+			}
 			return err
 		}
+		return runGCloud(cfg, cache, "scp", runGCloudSCP, unresolved, ansible)
+	}
 
-		err = updateWithInstanceName(projects, zones, &ansible)
-		if err != nil {
-			return err
+	ansible, err := ParseAnsibleArgs(os.Args)
+	if err != nil {
+		return err
+	}
+	if ansible.Quiet {
+		// Like ssh -q only the errors are still logged
+		logger.level = levelError
+	}
+
+	command, run := "ssh", runGCloudSSH
+	if ansible.Forward != "" {
+		// The IAP tunnel reaches the target without going through the
+		// destination, like a ProxyCommand bastion
+		command, run = "tunnel", runGCloudTunnel
+		ansible.Destination, ansible.Port, _ = net.SplitHostPort(ansible.Forward)
+	}
+	unresolved := ansible.clone()
+	err = updateWithInstanceName(ctx, cfg, cache, &ansible)
+	if err != nil {
+		if cfg.FallbackDirect && isUnresolved(err) {
+			logger.Warnf("Instance resolution failed, falling back to system-ssh to the original destination: %v", err)
+			return runSystemSSH(cfg, os.Args[1:])
 		}
-		runGCloudSSH(ansible)
+		return err
 	}
-	return nil
+	return runGCloud(cfg, cache, command, run, unresolved, ansible)
+}
+
+// Runs gcloud ssh or scp against the resolved instance. When a preemptible
+// instance can't be connected to it is resolved again from the unresolved
+// run, once, as it may have been recreated with another name reusing the IP.
+func runGCloud(cfg *Config, cache *resolutionCache, command string, run func(*Config, AnsibleRun) error, unresolved, ansible AnsibleRun) (err error) {
+	connected := ansible
+	defer func() { runPostHook(cfg, command, connected, err) }()
+	start := time.Now()
+	err = run(cfg, ansible)
+	logTiming(cfg, "gcloud "+command, start)
+	countGCloudRun(command, err)
+	if err == nil {
+		return nil
+	}
+	if !isConnectionFailure(err) {
+		return err
+	}
+	// The instance may have been recreated reusing the IP
+	cache.Invalidate(ansible.Host)
+	if !cfg.ReresolveOnFail || !ansible.Preemptible {
+		return err
+	}
+
+	logger.Warnf("Resolving the preemptible instance of %s again after the connection failure: %v", ansible.Host, err)
+	// The lookup deadline of the first resolution may be over
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	// The daemon may still have the instance in memory
+	refresh := *cfg
+	refresh.refresh = true
+	if resolveErr := updateWithInstanceName(ctx, &refresh, cache, &unresolved); resolveErr != nil {
+		logger.Warnf("Cannot resolve %s again: %v", ansible.Host, resolveErr)
+		return err
+	}
+	connected = unresolved
+	start = time.Now()
+	err = run(cfg, unresolved)
+	logTiming(cfg, "gcloud "+command, start)
+	countGCloudRun(command, err)
+	if isConnectionFailure(err) {
+		cache.Invalidate(unresolved.Host)
+	}
+	return err
+}
+
+// Logs the time a phase took since start when cfg.LogTiming is set
+func logTiming(cfg *Config, phase string, start time.Time) {
+	if cfg.LogTiming {
+		logger.Infof("Timing: %s took %v", phase, time.Since(start))
+	}
+}
+
+// Counts the gcloud ssh or scp runs by result and exit code
+func countGCloudRun(command string, err error) {
+	result, code := "success", 0
+	if err != nil {
+		result, code = "failure", exitCode(err)
+	}
+	stats.Incr("gcloud_ssh.gcloud."+result, "command:"+command, "exit_code:"+strconv.Itoa(code))
+}
+
+// Get the exit code of the child process that made the run fail
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() >= 0 {
+		return exitErr.ExitCode()
+	}
+	return exitCodeFailure
 }
 
 func main() {
-	closeLogger := setupLogger()
+	os.Exit(run())
+}
+
+// checks if the wrapper is asked for its version instead of running ssh or
+// scp, ansible never passes a version first argument
+func isVersionRequest(args []string) bool {
+	return len(args) > 1 && (args[1] == "--version" || args[1] == "version")
+}
+
+// checks if the wrapper runs as scp from the name it is invoked by, like a
+// scp or ssh symlink to it, doSCP when the name is neither or its own
+func isSCPInvocation(argv0 string, doSCP bool) bool {
+	name := filepath.Base(argv0)
+	switch {
+	case name == "gcloud-ssh":
+		return doSCP
+	case strings.HasSuffix(name, "scp"):
+		return true
+	case strings.HasSuffix(name, "ssh"):
+		return false
+	}
+	return doSCP
+}
+
+// errOut is where the wrapper reports its failures. It is stderr as ansible
+// takes stdout for the command output, like the module facts JSON.
+var errOut io.Writer = os.Stderr
+
+// Reports the failure as a single "gcloud-ssh: " prefixed line
+func reportError(w io.Writer, err error) {
+	reason := strings.Join(strings.Fields(err.Error()), " ")
+	fmt.Fprintf(w, "gcloud-ssh: %s\n", reason)
+}
+
+func run() int {
+	if isVersionRequest(os.Args) {
+		fmt.Printf("gcloud-ssh %s, commit %s, built at %s\n", version, commit, date)
+		return 0
+	}
+
+	rand.Seed(time.Now().UnixNano())
+
+	// The log is set up without a valid config too, and closed by every
+	// return, so it always tells why the wrapper failed
+	cfg, err := loadConfig(getEnv("GCLOUD_SSH_CONFIG", defaultConfigPath))
+	closeLogger := setupLogger(&cfg)
 	defer closeLogger()
+	if err == nil {
+		err = logger.configure(cfg.LogFormat, cfg.LogLevel)
+	}
+	if err != nil {
+		logger.Errorf("Invalid configuration: %v", err)
+		reportError(errOut, err)
+		return exitCodeConfig
+	}
+	redactKeys = append(redactKeys, cfg.RedactKeys...)
+	cfg.DoSCP = isSCPInvocation(os.Args[0], cfg.DoSCP)
+	stats = newStatsdClient(cfg.StatsdAddr)
+	defer stats.Close()
 
-	doSCP, _ := strconv.ParseBool(getEnv("DO_SCP", "false"))
-	zones := getEnvList("GCLOUD_SSH_ZONES", []string{})
-	projects := getEnvList("GCLOUD_SSH_PROJECTS", []string{})
+	// The deadline only applies to the compute API lookups, not to gcloud
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
 
-	if len(projects) == 0 {
-		ctx := context.Background()
-		credentials, err := google.FindDefaultCredentials(ctx, compute.ComputeScope)
+	if len(cfg.Projects) == 0 && cfg.Folder == "" && cfg.Project == "" {
+		project, err := defaultProject(ctx, &cfg)
 		if err != nil {
-			log.Fatal(err)
+			logger.Errorf("%v", err)
+			reportError(errOut, err)
+			return exitCodeConfig
+		}
+		cfg.Projects = []string{project}
+	}
+	// Scoped by the default project too, the users of other projects have
+	// their own entries
+	cache := newResolutionCache(cfg.CacheDir, cfg.CacheTTL, &cfg)
+	if isServeRequest(os.Args) {
+		if err := serve(&cfg); err != nil {
+			logger.Errorf("%v", err)
+			reportError(errOut, err)
+			return exitCodeFailure
 		}
-		projects = append(projects, credentials.ProjectID)
+		return 0
+	}
+	if isHealthcheckRequest(os.Args) {
+		return healthcheck(ctx, &cfg, os.Args[2:], os.Stdout)
 	}
-	log.Printf("Starting with zones: %v, projects: %v, doSCP: %v", zones, projects, doSCP)
+	if isInventoryRequest(os.Args) {
+		return inventory(ctx, &cfg, os.Args[2:], os.Stdout, os.Stderr)
+	}
+	if isResolveRequest(os.Args) {
+		return resolveHost(ctx, &cfg, cache, os.Args[2:], os.Stdout, os.Stderr)
+	}
+	logger.Infof("Starting with zones: %v, projects: %v, doSCP: %v, fallbackDirect: %v", cfg.Zones, cfg.Projects, cfg.DoSCP, cfg.FallbackDirect)
 
-	err := parseAndRun(doSCP, projects, zones)
+	err = parseAndRun(ctx, &cfg, cache)
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("compute API lookup timed out after %v: %w", cfg.Timeout, err)
+	}
 	if err != nil {
-		log.Println(err)
-		fmt.Println(err)
+		logger.Errorf("%v", err)
+		// The child process already reported its own failure, only the hint
+		// about its cause is added
+		var exitErr *exec.ExitError
+		var hintErr *hintError
+		if !errors.As(err, &exitErr) || errors.As(err, &hintErr) {
+			reportError(errOut, err)
+		}
+		return exitCode(err)
 	}
+	return 0
 }
@@ -6,84 +6,35 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
-)
+	"time"
 
-const (
-	argState    = 1
-	startState  = 2
-	quotesState = 3
+	"golang.org/x/oauth2"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
 )
 
-func parseCommandLine(command string) ([]string, error) {
-	var args []string
-	var quote byte = '"'
-	state := startState
-	current := ""
-	escapeNext := true
-	for i := 0; i < len(command); i++ {
-		c := command[i]
-
-		if state == quotesState {
-			if c != quote {
-				current += string(c)
-			} else {
-				args = append(args, current)
-				current = ""
-				state = startState
-			}
-			continue
-		}
-
-		if escapeNext {
-			current += string(c)
-			escapeNext = false
-			continue
-		}
-
-		if c == '\\' {
-			escapeNext = true
-			continue
-		}
-
-		if c == '"' || c == '\'' {
-			state = quotesState
-			quote = c
-			continue
-		}
-
-		if state == argState {
-			if c == ' ' || c == '\t' {
-				args = append(args, current)
-				current = ""
-				state = startState
-			} else {
-				current += string(c)
-			}
-			continue
-		}
-
-		if c != ' ' && c != '\t' {
-			state = argState
-			current += string(c)
-		}
-	}
-
-	if state == quotesState {
-		return []string{}, fmt.Errorf("Unclosed quote in command line: %s", command)
-	}
-
-	if current != "" {
-		args = append(args, current)
-	}
-
-	return args, nil
-}
-
 func TestSSH(t *testing.T) {
 	// gcloud compute ssh --tunnel-through-iap --quiet --zone "us-central1-a" "andy-awx-managed-1" --command "ls"
-	args, err := parseCommandLine(`-C -o ControlMaster=auto -o ControlPersist=60s -o StrictHostKeyChecking=no -o KbdInteractiveAuthentication=no -o PreferredAuthentications=gssapi-with-mic,gssapi-keyex,hostbased,publickey -o PasswordAuthentication=no -o User="andy_retailnext_net" -o ConnectTimeout=10 -o ControlPath=/tmp/awx_2826_wrtrtczl/cp/3c85463f3f 172.16.0.12 /bin/sh -c '/usr/bin/python3 && sleep 0'`)
+	args, err := ParseCommandLine(`-C -o ControlMaster=auto -o ControlPersist=60s -o StrictHostKeyChecking=no -o KbdInteractiveAuthentication=no -o PreferredAuthentications=gssapi-with-mic,gssapi-keyex,hostbased,publickey -o PasswordAuthentication=no -o User="andy_retailnext_net" -o ConnectTimeout=10 -o ControlPath=/tmp/awx_2826_wrtrtczl/cp/3c85463f3f 172.16.0.12 /bin/sh -c '/usr/bin/python3 && sleep 0'`)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -91,12 +42,15 @@ func TestSSH(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	expected := "/usr/bin/python3 && sleep 0"
-	if a.Command != expected {
-		t.Fatalf("'%v' != '%v'", a.Command, expected)
+	expected := "/bin/sh -c '/usr/bin/python3 && sleep 0'"
+	if a.remoteCommand() != expected {
+		t.Fatalf("'%v' != '%v'", a.remoteCommand(), expected)
+	}
+	if !reflect.DeepEqual(a.CommandArgs, []string{"/bin/sh", "-c", "/usr/bin/python3 && sleep 0"}) {
+		t.Fatalf("unexpected command arguments: %v", a.CommandArgs)
 	}
 
-	args2, err := parseCommandLine(`-C -o ControlMaster=auto -o ControlPersist=60s -o StrictHostKeyChecking=no -o KbdInteractiveAuthentication=no -o PreferredAuthentications=gssapi-with-mic,gssapi-keyex,hostbased,publickey -o PasswordAuthentication=no -o User="sa_111069622966946909314" -o ConnectTimeout=10 -o ControlPath=/tmp/awx_2848_uq4itrrn/cp/811b91f774 172.16.0.11 dd of=/home/sa_111069622966946909314/.ansible/tmp/ansible-tmp-1596502037.623799-215726-161858982386430/AnsiballZ_setup.py bs=65536`)
+	args2, err := ParseCommandLine(`-C -o ControlMaster=auto -o ControlPersist=60s -o StrictHostKeyChecking=no -o KbdInteractiveAuthentication=no -o PreferredAuthentications=gssapi-with-mic,gssapi-keyex,hostbased,publickey -o PasswordAuthentication=no -o User="sa_111069622966946909314" -o ConnectTimeout=10 -o ControlPath=/tmp/awx_2848_uq4itrrn/cp/811b91f774 172.16.0.11 dd of=/home/sa_111069622966946909314/.ansible/tmp/ansible-tmp-1596502037.623799-215726-161858982386430/AnsiballZ_setup.py bs=65536`)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -111,13 +65,160 @@ func TestSSH(t *testing.T) {
 	if a.Destination != "172.16.0.11" {
 		t.Fatalf("'%v' != '%v'", a.Destination, "172.16.0.11")
 	}
-	if a.Source != "" {
-		t.Fatalf("destination must be empty, found '%v'", a.Source)
+	if len(a.Sources) != 0 {
+		t.Fatalf("sources must be empty, found '%v'", a.Sources)
+	}
+}
+
+func TestSSHCommandQuoting(t *testing.T) {
+	commandArgs := []string{"/bin/sh", "-c", "echo 'it''s' \"$HOME\" && sleep 0", "", "a b"}
+	a, err := ParseAnsibleArgs(append([]string{"ssh", "-o", "User=andy", "172.16.0.11"}, commandArgs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a.CommandArgs, commandArgs) {
+		t.Fatalf("'%v' != '%v'", a.CommandArgs, commandArgs)
+	}
+	args := gcloudSSHArgs(&Config{}, a)
+	command := args[indexOf(args, "--command")+1]
+
+	// The remote shell gets back the arguments passed to ssh
+	out, err := exec.Command("sh", "-c", `eval "set -- $1"; for arg in "$@"; do echo "[$arg]"; done`, "sh", command).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ""
+	for _, arg := range commandArgs {
+		expected += "[" + arg + "]\n"
+	}
+	if string(out) != expected {
+		t.Fatalf("'%v' != '%v'", string(out), expected)
+	}
+
+	// The -c command is run instead of the command arguments
+	a, err = ParseAnsibleArgs(append([]string{"ssh", "-c", "uptime", "172.16.0.11"}, commandArgs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := gcloudSSHArgs(&Config{}, a); args[indexOf(args, "--command")+1] != "uptime" {
+		t.Fatalf("'%v' expected in %v", "uptime", args)
+	}
+}
+
+func TestSSHEmptyCommand(t *testing.T) {
+	// Connection probes only pass the destination
+	a, err := ParseAnsibleArgs([]string{"ssh", "-o", "User=andy", "172.16.0.11"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Command != "" || len(a.CommandArgs) != 0 {
+		t.Fatalf("unexpected command: %v %v", a.Command, a.CommandArgs)
+	}
+	a.Destination, a.Project, a.Zone = "instance-1", "project-1", "us-central1-a"
+	if args := gcloudSSHArgs(&Config{}, a); hasArg(args, "--command") {
+		t.Fatalf("unexpected command argument: %v", args)
+	}
+}
+
+func TestSSHForward(t *testing.T) {
+	for _, args := range [][]string{
+		{"ssh", "-o", "User=andy", "-W", "172.16.0.11:22", "bastion"},
+		{"ssh", "-o", "User=andy", "-W172.16.0.11:22", "bastion"},
+	} {
+		a, err := ParseAnsibleArgs(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Forward != "172.16.0.11:22" {
+			t.Fatalf("'%v' != '%v'", a.Forward, "172.16.0.11:22")
+		}
+		if a.Destination != "bastion" {
+			t.Fatalf("'%v' != '%v'", a.Destination, "bastion")
+		}
+	}
+	if _, err := ParseAnsibleArgs([]string{"ssh", "-W", "172.16.0.11", "bastion"}); err == nil {
+		t.Fatal("error expected without the forwarded port")
+	}
+
+	cfg := defaultConfig()
+	ar := AnsibleRun{Forward: "172.16.0.11:22", Destination: "instance-1", Port: "22", Zone: "us-central1-a", Project: "project-1"}
+	expected := []string{"compute", "start-iap-tunnel", "--quiet", "instance-1", "22", "--listen-on-stdin", "--project", "project-1", "--zone", "us-central1-a"}
+	if args := gcloudTunnelArgs(&cfg, ar); !reflect.DeepEqual(args, expected) {
+		t.Fatalf("'%v' != '%v'", args, expected)
+	}
+	cfg.UseIAP = false
+	if err := runGCloudTunnel(&cfg, ar); err == nil {
+		t.Fatal("error expected without IAP")
+	}
+}
+
+func TestSSHAgentTTY(t *testing.T) {
+	for _, test := range []struct {
+		flags    []string
+		expected []string
+	}{
+		{[]string{"-A"}, []string{"--ssh-flag=-A"}},
+		{[]string{"-t"}, []string{"--ssh-flag=-t"}},
+		{[]string{"-tt"}, []string{"--ssh-flag=-t", "--ssh-flag=-t"}},
+		{[]string{"-A", "-t"}, []string{"--ssh-flag=-A", "--ssh-flag=-t"}},
+		{[]string{"-At"}, []string{"--ssh-flag=-A", "--ssh-flag=-t"}},
+		{[]string{"-C"}, nil},
+	} {
+		args := append(append([]string{"ssh"}, test.flags...), "172.16.0.11", "ls")
+		a, err := ParseAnsibleArgs(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Destination != "172.16.0.11" || a.Command != "ls" {
+			t.Fatalf("%v: unexpected parsing: %v %v", test.flags, a.Destination, a.Command)
+		}
+		var flags []string
+		for _, arg := range gcloudSSHArgs(&Config{}, a) {
+			if arg == "--ssh-flag=-A" || arg == "--ssh-flag=-t" {
+				flags = append(flags, arg)
+			}
+		}
+		if !reflect.DeepEqual(flags, test.expected) {
+			t.Fatalf("%v: '%v' != '%v'", test.flags, flags, test.expected)
+		}
+	}
+}
+
+func TestSSHVerbosity(t *testing.T) {
+	for _, test := range []struct {
+		flags    []string
+		expected []string
+	}{
+		{[]string{"-v"}, []string{"--verbosity=debug", "--ssh-flag=-v"}},
+		{[]string{"-vvv"}, []string{"--verbosity=debug", "--ssh-flag=-vvv"}},
+		{[]string{"-v", "-vv"}, []string{"--verbosity=debug", "--ssh-flag=-vvv"}},
+		{[]string{"-q"}, []string{"--ssh-flag=-q"}},
+		{[]string{"-qv"}, []string{"--verbosity=debug", "--ssh-flag=-q", "--ssh-flag=-v"}},
+		{nil, nil},
+	} {
+		// -vvv takes no value, the destination follows
+		args := append(append([]string{"ssh"}, test.flags...), "172.16.0.11", "ls")
+		a, err := ParseAnsibleArgs(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Destination != "172.16.0.11" || a.Command != "ls" {
+			t.Fatalf("%v: unexpected parsing: %v %v", test.flags, a.Destination, a.Command)
+		}
+		var flags []string
+		for _, arg := range gcloudSSHArgs(&Config{}, a) {
+			if strings.HasPrefix(arg, "--verbosity") || strings.HasPrefix(arg, "--ssh-flag=-q") || strings.HasPrefix(arg, "--ssh-flag=-v") {
+				flags = append(flags, arg)
+			}
+		}
+		if !reflect.DeepEqual(flags, test.expected) {
+			t.Fatalf("%v: '%v' != '%v'", test.flags, flags, test.expected)
+		}
 	}
 }
 
 func TestSCP(t *testing.T) {
-	args3, err := parseCommandLine(`-C -o ControlMaster=auto -o ControlPersist=60s -o StrictHostKeyChecking=no -o KbdInteractiveAuthentication=no -o PreferredAuthentications=gssapi-with-mic,gssapi-keyex,hostbased,publickey -o PasswordAuthentication=no -o User="sa_111069622966946909314" -o ConnectTimeout=10 -o ControlPath=/tmp/awx_2850_mcg_tln7/cp/811b91f774 /var/lib/awx/.ansible/tmp/ansible-local-216033jdy7a18f/tmpja9h4a0t [172.16.0.11]:/home/sa_111069622966946909314/.ansible/tmp/ansible-tmp-1596502613.2008872-216047-259015317780472/AnsiballZ_setup.py`)
+	args3, err := ParseCommandLine(`-C -o ControlMaster=auto -o ControlPersist=60s -o StrictHostKeyChecking=no -o KbdInteractiveAuthentication=no -o PreferredAuthentications=gssapi-with-mic,gssapi-keyex,hostbased,publickey -o PasswordAuthentication=no -o User="sa_111069622966946909314" -o ConnectTimeout=10 -o ControlPath=/tmp/awx_2850_mcg_tln7/cp/811b91f774 /var/lib/awx/.ansible/tmp/ansible-local-216033jdy7a18f/tmpja9h4a0t [172.16.0.11]:/home/sa_111069622966946909314/.ansible/tmp/ansible-tmp-1596502613.2008872-216047-259015317780472/AnsiballZ_setup.py`)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -130,8 +231,8 @@ func TestSCP(t *testing.T) {
 		t.Fatalf("command must be empty, found '%v'", a.Command)
 	}
 	expected := `/var/lib/awx/.ansible/tmp/ansible-local-216033jdy7a18f/tmpja9h4a0t`
-	if a.Source != expected {
-		t.Fatalf("'%v' != '%v'", a.Source, expected)
+	if len(a.Sources) != 1 || a.Sources[0] != expected {
+		t.Fatalf("'%v' != '%v'", a.Sources, expected)
 	}
 	expected = `[172.16.0.11]:/home/sa_111069622966946909314/.ansible/tmp/ansible-tmp-1596502613.2008872-216047-259015317780472/AnsiballZ_setup.py`
 	if a.Destination != expected {
@@ -149,3 +250,1934 @@ func TestSCP(t *testing.T) {
 		t.Fatalf("'%v' != '%v'", ip, expected)
 	}
 }
+
+func TestParseMalformedArgs(t *testing.T) {
+	for _, flag := range []string{"-c", "-o", "-p", "-W"} {
+		if _, err := ParseAnsibleArgs([]string{"ssh", "172.16.0.11", flag}); err == nil || !strings.Contains(err.Error(), "Missing value") {
+			t.Fatalf("%v: missing value error expected, found: %v", flag, err)
+		}
+	}
+	for _, flag := range []string{"-o", "-P", "-l"} {
+		if _, err := ParseAnsibleSCP([]string{"scp", "/tmp/file", "172.16.0.11:/tmp/", flag}); err == nil || !strings.Contains(err.Error(), "Missing value") {
+			t.Fatalf("%v: missing value error expected, found: %v", flag, err)
+		}
+	}
+
+	// Empty arguments are not flags
+	a, err := ParseAnsibleArgs([]string{"ssh", "172.16.0.11", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Destination != "172.16.0.11" || !reflect.DeepEqual(a.CommandArgs, []string{""}) {
+		t.Fatalf("unexpected parse: %#+v", a)
+	}
+	if _, err := ParseAnsibleSCP([]string{"scp", "", "/tmp/file", "172.16.0.11:/tmp/"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseCommandLine(t *testing.T) {
+	for command, expected := range map[string][]string{
+		`ls -la /tmp`:                       {"ls", "-la", "/tmp"},
+		`  ls	 -la  `:                       {"ls", "-la"},
+		`sh -c 'echo "a b" && sleep 0'`:     {"sh", "-c", `echo "a b" && sleep 0`},
+		`-o User="foo" -o "Opt=a b"`:        {"-o", "User=foo", "-o", "Opt=a b"},
+		`echo a\ b`:                         {"echo", "a b"},
+		`"--verbosity=debug" --internal-ip`: {"--verbosity=debug", "--internal-ip"},
+		`a"b c"d`:                           {"ab cd"},
+		`-o Opt="a b"'c d' x`:               {"-o", "Opt=a bc d", "x"},
+		`"a"'b' "" c`:                       {"ab", "", "c"},
+		`\ a`:                               {" a"},
+	} {
+		args, err := ParseCommandLine(command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(args, expected) {
+			t.Fatalf("%v: '%v' != '%v'", command, args, expected)
+		}
+	}
+
+	if _, err := ParseCommandLine(`sh -c 'echo`); err == nil {
+		t.Fatal("unclosed quote error expected")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	err := exec.Command("sh", "-c", "exit 3").Run()
+	if code := exitCode(err); code != 3 {
+		t.Fatalf("'%v' != '%v'", code, 3)
+	}
+
+	err = exec.Command("gcloud-ssh-not-found").Run()
+	if code := exitCode(err); code != exitCodeFailure {
+		t.Fatalf("'%v' != '%v'", code, exitCodeFailure)
+	}
+
+	err = fmt.Errorf("run failed: %w", errors.New("Not found networkIP: 172.16.0.11"))
+	if code := exitCode(err); code != exitCodeFailure {
+		t.Fatalf("'%v' != '%v'", code, exitCodeFailure)
+	}
+}
+
+func TestExtractIP(t *testing.T) {
+	tests := map[string]string{
+		"[2600:1900::1]:/path": "2600:1900::1",
+		"[2600:1900::1]":       "2600:1900::1",
+		"[172.16.0.11]:/path":  "172.16.0.11",
+		"172.16.0.11:/path":    "172.16.0.11",
+		"172.16.0.11":          "172.16.0.11",
+		"[172.16.0.11]":        "172.16.0.11",
+		"2600:1900::1":         "2600:1900::1",
+		"andy@2600:1900::1":    "2600:1900::1",
+		// Remote paths may have colons
+		"172.16.0.11:/tmp/ansible-tmp-1:2:3/file": "172.16.0.11",
+		"[2600:1900::1]:C:/Users/andy":            "2600:1900::1",
+	}
+	for destination, expected := range tests {
+		ip := ExtractIP(destination)
+		if ip != expected {
+			t.Fatalf("%v: '%v' != '%v'", destination, ip, expected)
+		}
+	}
+
+	// Only the host is replaced, never the path
+	for target, expected := range map[string]string{
+		"andy@172.16.0.11:/tmp/172.16.0.11:22.log": "andy@instance-1:/tmp/172.16.0.11:22.log",
+		"[172.16.0.11]:/tmp/[172.16.0.11]:file":    "instance-1:/tmp/[172.16.0.11]:file",
+		"172.16.0.11:C:/Users/andy":                "instance-1:C:/Users/andy",
+	} {
+		if replaced := replaceIP(target, "172.16.0.11", "instance-1"); replaced != expected {
+			t.Fatalf("%v: '%v' != '%v'", target, replaced, expected)
+		}
+	}
+}
+
+func TestSSHBareIPv6(t *testing.T) {
+	a, err := ParseAnsibleArgs([]string{"ssh", "-C", "andy@2600:1900::1", "/bin/sh -c 'echo ~andy && sleep 0'"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Destination != "andy@2600:1900::1" || a.Port != "" {
+		t.Fatalf("unexpected destination: %v %v", a.Destination, a.Port)
+	}
+	ip := ExtractIP(a.Destination)
+	if ip != "2600:1900::1" {
+		t.Fatalf("'%v' != '%v'", ip, "2600:1900::1")
+	}
+	if destination := replaceIP(a.Destination, ip, "instance-1"); destination != "andy@instance-1" {
+		t.Fatalf("'%v' != '%v'", destination, "andy@instance-1")
+	}
+}
+
+func TestInterfaceHasIPv6(t *testing.T) {
+	ni := &compute.NetworkInterface{
+		NetworkIP:   "172.16.0.11",
+		Ipv6Address: "2600:1900:0:0::1",
+		Ipv6AccessConfigs: []*compute.AccessConfig{
+			{ExternalIpv6: "2600:1901:0:abcd::"},
+		},
+	}
+
+	for _, networkIP := range []string{"172.16.0.11", "2600:1900::1", "2600:1900:0:0:0:0:0:1", "2600:1901:0:abcd::"} {
+		if !interfaceHasIP(ni, networkIP) {
+			t.Fatalf("%v must match the dual-stack interface", networkIP)
+		}
+	}
+	for _, networkIP := range []string{"172.16.0.12", "2600:1900::2"} {
+		if interfaceHasIP(ni, networkIP) {
+			t.Fatalf("%v must not match the dual-stack interface", networkIP)
+		}
+	}
+}
+
+// roundTripFunc fakes the compute API transport
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func jsonResponse(code int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: code,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func newFakeComputeService(t *testing.T, transport roundTripFunc) *compute.Service {
+	computeService, err := compute.NewService(context.Background(), option.WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return computeService
+}
+
+// Replaces the compute client of the lookups with a fake one answering with
+// transport until the test ends
+func stubComputeService(t *testing.T, transport roundTripFunc) {
+	stubBuildComputeService(t, func(ctx context.Context, cfg *Config) (*compute.Service, error) {
+		return newFakeComputeService(t, transport), nil
+	})
+}
+
+// Replaces how the compute clients of the lookups are built until the test
+// ends, forgetting the clients already built
+func stubBuildComputeService(t *testing.T, build func(context.Context, *Config) (*compute.Service, error)) {
+	original := buildComputeService
+	t.Cleanup(func() {
+		buildComputeService = original
+		computeServiceOnce = sync.Once{}
+		projectComputeServices = map[string]*compute.Service{}
+	})
+	computeServiceOnce = sync.Once{}
+	buildComputeService = build
+}
+
+const aggregatedListResponse = `{
+	"items": {
+		"zones/us-central1-a": {
+			"instances": [
+				{"name": "instance-1", "networkInterfaces": [{"networkIP": "172.16.0.11"}]}
+			]
+		},
+		"zones/us-central1-b": {
+			"warning": {"code": "NO_RESULTS_ON_PAGE"}
+		}
+	}
+}`
+
+func TestFindInstanceIPForms(t *testing.T) {
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(http.StatusOK, aggregatedListResponse), nil
+	})
+	cfg := &Config{Projects: []string{"project-1"}, MaxRetries: 4, Concurrency: 1}
+	for _, networkIP := range []string{"172.16.0.11", "172.016.000.011", "::ffff:172.16.0.11"} {
+		instanceName, _, _, err := findInstance(context.Background(), computeService, cfg, networkIP)
+		if err != nil {
+			t.Fatalf("%v: %v", networkIP, err)
+		}
+		if instanceName != "instance-1" {
+			t.Fatalf("'%v' != '%v'", instanceName, "instance-1")
+		}
+	}
+
+	for text, expected := range map[string]string{
+		"172.016.000.012": "172.16.0.12",
+		"010.0.0.1":       "10.0.0.1",
+		"172.16.0":        "<nil>",
+		"instance-1":      "<nil>",
+		"172..0.1":        "<nil>",
+	} {
+		if ip := parseIP(text); ip.String() != expected {
+			t.Fatalf("%v: '%v' != '%v'", text, ip, expected)
+		}
+	}
+	if !sameIP("034.120.001.002", "34.120.1.2") || sameIP("instance-1", "34.120.1.2") {
+		t.Fatal("IPs must be compared by value")
+	}
+}
+
+func TestFindInstancePages(t *testing.T) {
+	// The aggregated list has the instances keyed by zone, the zonal list as an array
+	pages := map[string][2]string{
+		"": {
+			`{"items": {"zones/us-central1-a": {"instances": [{"name": "instance-2", "networkInterfaces": [{"networkIP": "172.16.0.12"}]}]}}, "nextPageToken": "page-2"}`,
+			aggregatedListResponse,
+		},
+		"us-central1-a": {
+			`{"items": [{"name": "instance-2", "networkInterfaces": [{"networkIP": "172.16.0.12"}]}], "nextPageToken": "page-2"}`,
+			`{"items": [{"name": "instance-1", "networkInterfaces": [{"networkIP": "172.16.0.11"}]}]}`,
+		},
+	}
+	for zone, responses := range pages {
+		responses := responses
+		computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+			if req.URL.Query().Get("pageToken") == "page-2" {
+				return jsonResponse(http.StatusOK, responses[1]), nil
+			}
+			return jsonResponse(http.StatusOK, responses[0]), nil
+		})
+
+		cfg := &Config{Projects: []string{"project-1"}, MaxRetries: 4, Concurrency: 8}
+		if zone != "" {
+			cfg.Zones = []string{zone}
+		}
+		instanceName, instanceZone, _, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if instanceName != "instance-1" || instanceZone != "us-central1-a" {
+			t.Fatalf("unexpected instance: %v %v", instanceName, instanceZone)
+		}
+	}
+}
+
+func TestFindInstanceMaxScan(t *testing.T) {
+	// Every page has two other instances and a next page
+	requests := 0
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		requests++
+		return jsonResponse(http.StatusOK, `{"items": {"zones/us-central1-a": {"instances": [
+			{"name": "instance-2", "networkInterfaces": [{"networkIP": "172.16.0.12"}]},
+			{"name": "instance-3", "networkInterfaces": [{"networkIP": "172.16.0.13"}]}
+		]}}, "nextPageToken": "next"}`), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1"}, MaxRetries: 4, MaxScan: 5, Concurrency: 1}
+	_, _, _, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11")
+	if err == nil || !strings.Contains(err.Error(), "GCLOUD_SSH_MAX_SCAN") {
+		t.Fatalf("max scan error expected, found '%v'", err)
+	}
+	if requests != 3 {
+		t.Fatalf("'%v' != '%v'", requests, 3)
+	}
+}
+
+func TestFindInstanceNetwork(t *testing.T) {
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(http.StatusOK, `{"items": {"zones/us-central1-a": {"instances": [
+			{"name": "instance-1", "networkInterfaces": [{"network": "https://www.googleapis.com/compute/v1/projects/project-1/global/networks/prod", "networkIP": "172.16.0.11"}]},
+			{"name": "instance-2", "networkInterfaces": [{"network": "https://www.googleapis.com/compute/v1/projects/project-1/global/networks/staging", "networkIP": "172.16.0.11"}]}
+		]}}}`), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1"}, MaxRetries: 4, Concurrency: 8}
+	if _, _, _, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11"); err == nil || !strings.Contains(err.Error(), "GCLOUD_SSH_NETWORK") {
+		t.Fatalf("ambiguous instance error expected, found '%v'", err)
+	}
+	for network, expected := range map[string]string{
+		"staging": "instance-2",
+		"projects/project-1/global/networks/prod":                                          "instance-1",
+		"https://www.googleapis.com/compute/v1/projects/project-1/global/networks/staging": "instance-2",
+	} {
+		cfg.Network = network
+		instanceName, _, _, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if instanceName != expected {
+			t.Fatalf("%v: '%v' != '%v'", network, instanceName, expected)
+		}
+	}
+}
+
+func TestFindInstanceAliasRange(t *testing.T) {
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(http.StatusOK, `{"items": {"zones/us-central1-a": {"instances": [
+			{"name": "instance-1", "networkInterfaces": [{"networkIP": "172.16.0.11", "aliasIpRanges": [{"ipCidrRange": "10.8.1.0/24"}]}]},
+			{"name": "instance-2", "networkInterfaces": [{"networkIP": "172.16.0.12", "aliasIpRanges": [{"ipCidrRange": "10.8.2.7/32"}]}]}
+		]}}}`), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1"}, MaxRetries: 4, Concurrency: 8}
+	for ip, expected := range map[string]string{"10.8.1.42": "instance-1", "10.8.2.7": "instance-2"} {
+		instanceName, _, _, err := findInstance(context.Background(), computeService, cfg, ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if instanceName != expected {
+			t.Fatalf("'%v' != '%v'", instanceName, expected)
+		}
+	}
+	if _, _, _, err := findInstance(context.Background(), computeService, cfg, "10.8.2.8"); err == nil {
+		t.Fatal("not found error expected")
+	}
+}
+
+func TestFindInstanceExternalIP(t *testing.T) {
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(http.StatusOK, `{"items": {"zones/us-central1-a": {"instances": [
+			{"name": "instance-1", "networkInterfaces": [{"networkIP": "172.16.0.11", "accessConfigs": [{"natIP": "203.0.113.10"}]}]}
+		]}}}`), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1"}, MatchExternal: true, MaxRetries: 4, Concurrency: 8}
+	instanceName, zone, project, err := findInstance(context.Background(), computeService, cfg, "203.0.113.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instanceName != "instance-1" || zone != "us-central1-a" || project != "project-1" {
+		t.Fatalf("unexpected instance: %v %v %v", instanceName, zone, project)
+	}
+
+	cfg.MatchExternal = false
+	if _, _, _, err := findInstance(context.Background(), computeService, cfg, "203.0.113.10"); err == nil {
+		t.Fatal("not found error expected")
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for _, delay := range []time.Duration{0, time.Nanosecond, time.Millisecond, time.Second} {
+		for i := 0; i < 100; i++ {
+			if sleep := jitter(delay); sleep < delay/2 || sleep > delay {
+				t.Fatalf("%v: sleep %v out of [%v, %v]", delay, sleep, delay/2, delay)
+			}
+		}
+	}
+}
+
+func TestFindInstanceRetry(t *testing.T) {
+	retryBaseDelay = time.Millisecond
+	requests := 0
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		requests++
+		if requests <= 2 {
+			return jsonResponse(http.StatusServiceUnavailable, `{"error": {"code": 503, "message": "Backend Error"}}`), nil
+		}
+		return jsonResponse(http.StatusOK, aggregatedListResponse), nil
+	})
+
+	instanceName, zone, project, err := findInstance(context.Background(), computeService, &Config{Projects: []string{"project-1"}, MaxRetries: 4, Concurrency: 8}, "172.16.0.11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 3 {
+		t.Fatalf("'%v' != '%v'", requests, 3)
+	}
+	if instanceName != "instance-1" || zone != "us-central1-a" || project != "project-1" {
+		t.Fatalf("unexpected instance: %v %v %v", instanceName, zone, project)
+	}
+}
+
+func TestFindInstanceNoRetry(t *testing.T) {
+	retryBaseDelay = time.Millisecond
+	requests := 0
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		requests++
+		return jsonResponse(http.StatusForbidden, `{"error": {"code": 403, "message": "Forbidden"}}`), nil
+	})
+
+	_, _, _, err := findInstance(context.Background(), computeService, &Config{Projects: []string{"project-1"}, MaxRetries: 4, Concurrency: 8}, "172.16.0.11")
+	if err == nil {
+		t.Fatal("forbidden error expected")
+	}
+	if requests != 1 {
+		t.Fatalf("'%v' != '%v'", requests, 1)
+	}
+}
+
+func TestFindInstanceForbiddenProject(t *testing.T) {
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/projects/project-1/") {
+			return jsonResponse(http.StatusForbidden, `{"error": {"code": 403, "message": "Required 'compute.instances.list' permission"}}`), nil
+		}
+		return jsonResponse(http.StatusOK, aggregatedListResponse), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1", "project-2"}, MaxRetries: 4, Concurrency: 1}
+	_, _, project, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if project != "project-2" {
+		t.Fatalf("'%v' != '%v'", project, "project-2")
+	}
+
+	// Without any project searched the instance is not known to be missing
+	cfg.Projects = []string{"project-1"}
+	_, _, _, err = findInstance(context.Background(), computeService, cfg, "172.16.0.11")
+	var apiErr *googleapi.Error
+	if errors.Is(err, ErrInstanceNotFound) || !errors.As(err, &apiErr) || apiErr.Code != http.StatusForbidden {
+		t.Fatalf("search error wrapping the API error expected, found '%v'", err)
+	}
+}
+
+func TestFindInstanceTimeout(t *testing.T) {
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, _, err := findInstance(ctx, computeService, &Config{Projects: []string{"project-1"}, MaxRetries: 4, Concurrency: 8}, "172.16.0.11")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("deadline exceeded expected, found '%v'", err)
+	}
+}
+
+func TestFindInstanceAmbiguous(t *testing.T) {
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/projects/project-3/") {
+			return jsonResponse(http.StatusOK, `{"items": {}}`), nil
+		}
+		return jsonResponse(http.StatusOK, aggregatedListResponse), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1", "project-2", "project-3"}, MaxRetries: 4, Concurrency: 4}
+	_, _, _, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11")
+	if err == nil {
+		t.Fatal("ambiguous instance error expected")
+	}
+	for _, candidate := range []string{
+		"project: project-1 zone: us-central1-a instance: instance-1",
+		"project: project-2 zone: us-central1-a instance: instance-1",
+	} {
+		if !strings.Contains(err.Error(), candidate) {
+			t.Fatalf("'%v' expected in '%v'", candidate, err)
+		}
+	}
+
+	cfg.Projects = []string{"project-2", "project-3"}
+	instanceName, zone, project, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instanceName != "instance-1" || zone != "us-central1-a" || project != "project-2" {
+		t.Fatalf("unexpected instance: %v %v %v", instanceName, zone, project)
+	}
+}
+
+func TestFindInstancePartialFailure(t *testing.T) {
+	retryBaseDelay = time.Millisecond
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/zones/us-central1-a/") {
+			return jsonResponse(http.StatusOK, `{"items": [{"name": "instance-1", "networkInterfaces": [{"networkIP": "172.16.0.11"}]}]}`), nil
+		}
+		return jsonResponse(http.StatusNotFound, `{"error": {"code": 404, "message": "Unknown zone"}}`), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1"}, Zones: []string{"us-central1-x", "us-central1-y", "us-central1-a"}, MaxRetries: 4, Concurrency: 1}
+	instanceName, zone, _, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instanceName != "instance-1" || zone != "us-central1-a" {
+		t.Fatalf("unexpected instance: %v %v", instanceName, zone)
+	}
+
+	cfg.Zones = cfg.Zones[:2]
+	_, _, _, err = findInstance(context.Background(), computeService, cfg, "172.16.0.11")
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusNotFound {
+		t.Fatalf("aggregated API error expected, found '%v'", err)
+	}
+}
+
+func TestFindInstanceHostProject(t *testing.T) {
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		// Both service projects reuse the IP, only project-2 uses the host project VPC
+		network := "https://www.googleapis.com/compute/v1/projects/project-1/global/networks/default"
+		if strings.Contains(req.URL.Path, "/projects/project-2/") {
+			network = "https://www.googleapis.com/compute/v1/projects/host-project/global/networks/shared"
+		}
+		return jsonResponse(http.StatusOK, fmt.Sprintf(`{"items": {"zones/us-central1-a": {"instances": [
+			{"name": "instance-1", "networkInterfaces": [{"network": %q, "networkIP": "172.16.0.11"}]}
+		]}}}`, network)), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1", "project-2"}, HostProject: "host-project", MaxRetries: 4, Concurrency: 1}
+	instanceName, zone, project, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instanceName != "instance-1" || zone != "us-central1-a" || project != "project-2" {
+		t.Fatalf("unexpected instance: %v %v %v", instanceName, zone, project)
+	}
+
+	cfg.Projects = []string{"project-1"}
+	if _, _, _, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11"); err == nil {
+		t.Fatal("not found error expected")
+	}
+}
+
+func TestAllowedProjects(t *testing.T) {
+	var mu sync.Mutex
+	searched := []string{}
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		searched = append(searched, req.URL.Path)
+		mu.Unlock()
+		return jsonResponse(http.StatusOK, aggregatedListResponse), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1", "project-2"}, AllowedProjects: []string{"project-2"}, MaxRetries: 4, Concurrency: 1}
+	_, _, project, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if project != "project-2" || len(searched) != 1 || !strings.Contains(searched[0], "/projects/project-2/") {
+		t.Fatalf("only project-2 must be searched, found %v in %v", project, searched)
+	}
+
+	// Without allowlist every project is searched
+	searched = searched[:0]
+	cfg.AllowedProjects = nil
+	if _, _, _, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11"); err == nil {
+		t.Fatal("ambiguous error expected")
+	}
+	if len(searched) != 2 {
+		t.Fatalf("'%v' != '%v'", len(searched), 2)
+	}
+
+	dir, err := ioutil.TempDir("", "gcloud-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := newResolutionCache(dir, time.Minute, &Config{})
+	cache.Put("172.16.0.11", cacheEntry{Instance: "instance-1", Zone: "us-central1-a", Project: "project-1"})
+
+	a := AnsibleRun{Destination: "172.16.0.11"}
+	cfg.AllowedProjects = []string{"project-2"}
+	if err := updateWithInstanceName(context.Background(), cfg, cache, &a); !errors.Is(err, ErrProjectNotAllowed) {
+		t.Fatalf("'%v' != '%v'", err, ErrProjectNotAllowed)
+	}
+	if a.Destination != "172.16.0.11" {
+		t.Fatalf("refused destination must not be resolved, found '%v'", a.Destination)
+	}
+
+	cfg.AllowedProjects = nil
+	if err := updateWithInstanceName(context.Background(), cfg, cache, &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Destination != "instance-1" || a.Project != "project-1" {
+		t.Fatalf("unexpected resolution: %v %v", a.Destination, a.Project)
+	}
+}
+
+func TestFindInstanceIAPTag(t *testing.T) {
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(http.StatusOK, `{"items": {"zones/us-central1-a": {"instances": [
+			{"name": "instance-1", "networkInterfaces": [{"networkIP": "172.16.0.11"}]},
+			{"name": "instance-2", "tags": {"items": ["http-server", "iap-ssh"]}, "networkInterfaces": [{"networkIP": "172.16.0.11"}]},
+			{"name": "instance-3", "tags": {"items": ["http-server"]}, "networkInterfaces": [{"networkIP": "172.16.0.13"}]}
+		]}}}`), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1"}, RequireIAPTag: "iap-ssh", MaxRetries: 4, Concurrency: 1}
+	instanceName, _, _, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instanceName != "instance-2" {
+		t.Fatalf("'%v' != '%v'", instanceName, "instance-2")
+	}
+	if _, _, _, err := findInstanceByName(context.Background(), computeService, cfg, "instance-3"); !errors.Is(err, ErrInstanceNotFound) {
+		t.Fatalf("'%v' != '%v'", err, ErrInstanceNotFound)
+	}
+
+	// Any instance matches without the tag
+	cfg.RequireIAPTag = ""
+	if _, _, _, err := findInstanceByName(context.Background(), computeService, cfg, "instance-3"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindInstanceMultiNIC(t *testing.T) {
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(http.StatusOK, `{"items": {"zones/us-central1-a": {"instances": [
+			{"name": "instance-1", "networkInterfaces": [{"name": "nic0", "networkIP": "10.0.0.11"}, {"name": "nic1", "networkIP": "172.16.0.11"}]},
+			{"name": "instance-2", "networkInterfaces": [{"name": "nic0", "networkIP": "172.16.0.12"}]}
+		]}}}`), nil
+	})
+
+	cfg := defaultConfig()
+	cfg.Projects = []string{"project-1"}
+	match, err := searchInstance(context.Background(), computeService, &cfg, addressQuery(&cfg, "172.16.0.11"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match.instance != "instance-1" || match.networkInterface != "nic1" {
+		t.Fatalf("unexpected match: %+v", match)
+	}
+	a := AnsibleRun{Destination: "instance-1", Command: "ls", NetworkInterface: match.networkInterface}
+	if args := gcloudSSHArgs(&cfg, a); !hasArg(args, "--network-interface=nic1") || hasArg(args, "--internal-ip") {
+		t.Fatalf("unexpected flags in %v", args)
+	}
+	cfg.UseIAP = false
+	if args := gcloudSCPArgs(&cfg, a); !hasArg(args, "--network-interface=nic1") || !hasArg(args, "--internal-ip") {
+		t.Fatalf("unexpected flags in %v", args)
+	}
+
+	// Single NIC instances connect as before
+	match, err = searchInstance(context.Background(), computeService, &cfg, addressQuery(&cfg, "172.16.0.12"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match.instance != "instance-2" || match.networkInterface != "" {
+		t.Fatalf("unexpected match: %+v", match)
+	}
+	a.NetworkInterface = match.networkInterface
+	if args := gcloudSSHArgs(&cfg, a); hasArg(args, "--network-interface=nic0") || hasArg(args, "--internal-ip") {
+		t.Fatalf("unexpected flags in %v", args)
+	}
+}
+
+func TestComputeClientOptionsImpersonate(t *testing.T) {
+	defer func(original func(context.Context, impersonate.CredentialsConfig, ...option.ClientOption) (oauth2.TokenSource, error)) {
+		impersonatedTokenSource = original
+	}(impersonatedTokenSource)
+	var impersonated []impersonate.CredentialsConfig
+	impersonatedTokenSource = func(ctx context.Context, config impersonate.CredentialsConfig, opts ...option.ClientOption) (oauth2.TokenSource, error) {
+		impersonated = append(impersonated, config)
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}), nil
+	}
+
+	os.Setenv("GCLOUD_SSH_IMPERSONATE_SA", "lookup@project-1.iam.gserviceaccount.com")
+	defer os.Unsetenv("GCLOUD_SSH_IMPERSONATE_SA")
+	cfg := defaultConfig()
+	if err := cfg.applyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := computeClientOptions(context.Background(), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(impersonated) != 1 {
+		t.Fatalf("'%v' != '%v'", len(impersonated), 1)
+	}
+	if impersonated[0].TargetPrincipal != "lookup@project-1.iam.gserviceaccount.com" || len(impersonated[0].Scopes) != 1 || impersonated[0].Scopes[0] != compute.ComputeReadonlyScope {
+		t.Fatalf("unexpected impersonation: %+v", impersonated[0])
+	}
+
+	os.Unsetenv("GCLOUD_SSH_IMPERSONATE_SA")
+	cfg = defaultConfig()
+	if err := cfg.applyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := computeClientOptions(context.Background(), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(impersonated) != 1 {
+		t.Fatal("the default credentials must not be impersonated")
+	}
+}
+
+func TestComputeClientOptionsCredentialsFile(t *testing.T) {
+	defer func(original func(context.Context, impersonate.CredentialsConfig, ...option.ClientOption) (oauth2.TokenSource, error)) {
+		impersonatedTokenSource = original
+	}(impersonatedTokenSource)
+	var impersonatedWith []option.ClientOption
+	impersonatedTokenSource = func(ctx context.Context, config impersonate.CredentialsConfig, opts ...option.ClientOption) (oauth2.TokenSource, error) {
+		impersonatedWith = opts
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}), nil
+	}
+
+	os.Setenv("GCLOUD_SSH_CREDENTIALS_FILE", "/etc/gcloud-ssh/playbook.json")
+	defer os.Unsetenv("GCLOUD_SSH_CREDENTIALS_FILE")
+	cfg := defaultConfig()
+	if err := cfg.applyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	credentialsFile := option.WithCredentialsFile("/etc/gcloud-ssh/playbook.json")
+	opts, err := computeClientOptions(context.Background(), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasOption(opts, credentialsFile) {
+		t.Fatalf("credentials file option expected in %v", opts)
+	}
+
+	cfg.ImpersonateSA = "lookup@project-1.iam.gserviceaccount.com"
+	if opts, err = computeClientOptions(context.Background(), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if hasOption(opts, credentialsFile) || !hasOption(impersonatedWith, credentialsFile) {
+		t.Fatalf("the credentials file must impersonate, found %v and %v", opts, impersonatedWith)
+	}
+
+	os.Unsetenv("GCLOUD_SSH_CREDENTIALS_FILE")
+	cfg = defaultConfig()
+	if err := cfg.applyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if opts, err = computeClientOptions(context.Background(), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if hasOption(opts, credentialsFile) {
+		t.Fatalf("the default credentials must be used, found %v", opts)
+	}
+}
+
+func TestDefaultProject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcloud-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := defaultConfig()
+
+	cfg.CredentialsFile = dir + "/user.json"
+	if err := ioutil.WriteFile(cfg.CredentialsFile, []byte(`{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "token"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := defaultProject(context.Background(), &cfg); err == nil || !strings.Contains(err.Error(), "set GCLOUD_SSH_PROJECTS") {
+		t.Fatalf("no project error expected, found '%v'", err)
+	}
+
+	cfg.CredentialsFile = dir + "/missing.json"
+	if _, err := defaultProject(context.Background(), &cfg); err == nil || !strings.Contains(err.Error(), "application-default login") {
+		t.Fatalf("missing credentials error expected, found '%v'", err)
+	}
+}
+
+func hasOption(opts []option.ClientOption, opt option.ClientOption) bool {
+	for _, o := range opts {
+		if reflect.DeepEqual(o, opt) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNewComputeServiceOptions(t *testing.T) {
+	defer func(original func(context.Context, impersonate.CredentialsConfig, ...option.ClientOption) (oauth2.TokenSource, error)) {
+		impersonatedTokenSource = original
+	}(impersonatedTokenSource)
+	impersonatedTokenSource = func(ctx context.Context, config impersonate.CredentialsConfig, opts ...option.ClientOption) (oauth2.TokenSource, error) {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}), nil
+	}
+
+	var quotaProjects []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/compute/v1/projects/project-1/aggregated/instances" {
+			t.Errorf("unexpected path: %v", req.URL.Path)
+		}
+		if userAgent := req.Header.Get("User-Agent"); !strings.HasPrefix(userAgent, "gcloud-ssh/"+version) {
+			t.Errorf("unexpected user agent: %v", userAgent)
+		}
+		quotaProjects = append(quotaProjects, req.Header.Get("X-Goog-User-Project"))
+		w.Write([]byte(aggregatedListResponse))
+	}))
+	defer server.Close()
+
+	cfg := defaultConfig()
+	cfg.ImpersonateSA = "lookup@project-1.iam.gserviceaccount.com"
+	cfg.Projects = []string{"project-1"}
+	cfg.ComputeEndpoint = server.URL + "/compute/v1/"
+	for _, quotaProject := range []string{"", "quota-project"} {
+		cfg.QuotaProject = quotaProject
+		computeService, err := newComputeService(context.Background(), &cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := findInstance(context.Background(), computeService, &cfg, "172.16.0.11"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(quotaProjects, []string{"", "quota-project"}) {
+		t.Fatalf("unexpected quota projects: %v", quotaProjects)
+	}
+}
+
+func TestGetComputeServiceOnce(t *testing.T) {
+	builds := 0
+	stubBuildComputeService(t, func(ctx context.Context, cfg *Config) (*compute.Service, error) {
+		builds++
+		return newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+			return jsonResponse(http.StatusOK, aggregatedListResponse), nil
+		}), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1"}, MaxRetries: 4, Concurrency: 8}
+	for _, destination := range []string{"172.16.0.11", "instance-1"} {
+		a := AnsibleRun{Destination: destination}
+		if err := updateWithInstanceName(context.Background(), cfg, nil, &a); err != nil {
+			t.Fatal(err)
+		}
+		if a.Destination != "instance-1" {
+			t.Fatalf("'%v' != '%v'", a.Destination, "instance-1")
+		}
+	}
+	if builds != 1 {
+		t.Fatalf("'%v' != '%v'", builds, 1)
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	if _, err := ParseAnsibleArgs([]string{"ssh", "-C"}); !errors.Is(err, ErrEmptyDestination) {
+		t.Fatalf("empty destination error expected, found '%v'", err)
+	}
+	if _, err := ParseAnsibleSCP([]string{"scp", "[172.16.0.11]:/tmp/file"}); !errors.Is(err, ErrEmptySource) {
+		t.Fatalf("empty source error expected, found '%v'", err)
+	}
+	defer func(original func(context.Context, string) ([]string, error)) { lookupHost = original }(lookupHost)
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	cfg := defaultConfig()
+	if err := updateWithInstanceName(context.Background(), &cfg, nil, &AnsibleRun{Destination: "host.example.com"}); !errors.Is(err, ErrInvalidDestination) || !isUnresolved(err) {
+		t.Fatalf("invalid destination error expected, found '%v'", err)
+	}
+
+	retryBaseDelay = time.Millisecond
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/projects/project-2/") {
+			return jsonResponse(http.StatusForbidden, `{"error": {"code": 403, "message": "Forbidden"}}`), nil
+		}
+		return jsonResponse(http.StatusOK, aggregatedListResponse), nil
+	})
+	_, _, _, err := findInstance(context.Background(), computeService, &Config{Projects: []string{"project-1"}, MaxRetries: 4, Concurrency: 8}, "172.16.0.12")
+	var notFound *NotFoundError
+	if !errors.Is(err, ErrInstanceNotFound) || !errors.As(err, &notFound) || notFound.Query != "networkIP: 172.16.0.12" {
+		t.Fatalf("not found error expected, found '%v'", err)
+	}
+	if err.Error() != "Not found networkIP: 172.16.0.12" {
+		t.Fatalf("'%v' != '%v'", err.Error(), "Not found networkIP: 172.16.0.12")
+	}
+
+	// The API errors are wrapped
+	_, _, _, err = findInstance(context.Background(), computeService, &Config{Projects: []string{"project-1", "project-2"}, MaxRetries: 4, Concurrency: 8}, "172.16.0.12")
+	var apiErr *googleapi.Error
+	if !errors.Is(err, ErrInstanceNotFound) || !errors.As(err, &apiErr) || apiErr.Code != http.StatusForbidden {
+		t.Fatalf("not found error wrapping the API error expected, found '%v'", err)
+	}
+}
+
+func TestFindBinary(t *testing.T) {
+	path, err := findBinary("sh", "GCLOUD_SSH_GCLOUD_BIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path == "" {
+		t.Fatal("path of sh expected")
+	}
+
+	_, err = findBinary("/usr/lib/google-cloud-sdk/bin/not-gcloud", "GCLOUD_SSH_GCLOUD_BIN")
+	if err == nil || !strings.Contains(err.Error(), "GCLOUD_SSH_GCLOUD_BIN") {
+		t.Fatalf("error pointing to GCLOUD_SSH_GCLOUD_BIN expected, found '%v'", err)
+	}
+}
+
+func TestRunGCloudSSHStdin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcloud-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The fake gcloud copies its input like the remote dd does
+	output := dir + "/output"
+	gcloud := dir + "/gcloud"
+	if err := ioutil.WriteFile(gcloud, []byte("#!/bin/sh\ncat > "+output+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	input := dir + "/input"
+	if err := ioutil.WriteFile(input, []byte("file content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := os.Open(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	defer func(original *os.File) {
+		os.Stdin = original
+	}(os.Stdin)
+	os.Stdin = stdin
+
+	cfg := defaultConfig()
+	cfg.GcloudPath = gcloud
+	ar := AnsibleRun{Destination: "instance-1", Zone: "us-central1-a", Project: "project-1", Command: "dd of=/tmp/file bs=65536"}
+	if err := runGCloudSSH(&cfg, ar); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "file content" {
+		t.Fatalf("'%v' != '%v'", string(data), "file content")
+	}
+}
+
+func TestRunner(t *testing.T) {
+	defer func(original Runner) { runner = original }(runner)
+	type run struct {
+		name string
+		args []string
+	}
+	var runs []run
+	runner = func(name string, args []string, stderr io.Writer, timeout time.Duration) error {
+		runs = append(runs, run{name, args})
+		return nil
+	}
+
+	cfg := defaultConfig()
+	cfg.GcloudPath, cfg.SystemSCPPath = "true", "true"
+	ar := AnsibleRun{Sources: []string{"/tmp/file"}, Destination: "instance-1:/tmp/file", Zone: "us-central1-a", Project: "project-1"}
+	if err := runGCloudSCP(&cfg, ar); err != nil {
+		t.Fatal(err)
+	}
+	if err := runSystemSCP(&cfg, []string{"-i", "key", "/tmp/file", "172.16.0.11:/tmp/file"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("'%v' != '%v'", len(runs), 2)
+	}
+	if !strings.HasSuffix(runs[0].name, "/true") || !reflect.DeepEqual(runs[0].args, gcloudSCPArgs(&cfg, ar)) {
+		t.Fatalf("unexpected gcloud run: %v", runs[0])
+	}
+	if !reflect.DeepEqual(runs[1].args, []string{"-i", "key", "/tmp/file", "172.16.0.11:/tmp/file"}) {
+		t.Fatalf("unexpected system scp run: %v", runs[1])
+	}
+}
+
+func hasArg(args []string, arg string) bool {
+	return indexOf(args, arg) >= 0
+}
+
+func indexOf(args []string, arg string) int {
+	for i, a := range args {
+		if a == arg {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestGCloudArgsIAP(t *testing.T) {
+	ar := AnsibleRun{Command: "ls", Sources: []string{"/tmp/file"}, Destination: "instance-1:/tmp/file", Zone: "us-central1-a", Project: "project-1"}
+
+	cfg := defaultConfig()
+	if args := gcloudSSHArgs(&cfg, ar); !hasArg(args, "--tunnel-through-iap") {
+		t.Fatalf("--tunnel-through-iap expected in %v", args)
+	}
+	if args := gcloudSCPArgs(&cfg, ar); !hasArg(args, "--tunnel-through-iap") {
+		t.Fatalf("--tunnel-through-iap expected in %v", args)
+	}
+
+	cfg.UseIAP = false
+	if args := gcloudSSHArgs(&cfg, ar); hasArg(args, "--tunnel-through-iap") {
+		t.Fatalf("--tunnel-through-iap not expected in %v", args)
+	}
+	if args := gcloudSCPArgs(&cfg, ar); hasArg(args, "--tunnel-through-iap") {
+		t.Fatalf("--tunnel-through-iap not expected in %v", args)
+	}
+}
+
+func TestGCloudArgsQuiet(t *testing.T) {
+	defer os.Unsetenv("GCLOUD_SSH_QUIET")
+	ar := AnsibleRun{Command: "ls", Sources: []string{"/tmp/file"}, Destination: "instance-1:/tmp/file", Zone: "us-central1-a", Project: "project-1"}
+	for value, quiet := range map[string]bool{"": true, "true": true, "false": false} {
+		os.Setenv("GCLOUD_SSH_QUIET", value)
+		cfg := defaultConfig()
+		if err := cfg.applyEnv(); err != nil {
+			t.Fatal(err)
+		}
+		if args := gcloudSSHArgs(&cfg, ar); hasArg(args, "--quiet") != quiet {
+			t.Fatalf("%q: --quiet %v in %v", value, quiet, args)
+		}
+		if args := gcloudSCPArgs(&cfg, ar); hasArg(args, "--quiet") != quiet {
+			t.Fatalf("%q: --quiet %v in %v", value, quiet, args)
+		}
+	}
+}
+
+func TestGCloudArgsKeyFile(t *testing.T) {
+	defer os.Unsetenv("GCLOUD_SSH_KEY_FILE")
+	defer os.Unsetenv("GCLOUD_SSH_FORCE_KEY_FILE_OVERWRITE")
+	ar := AnsibleRun{Command: "ls", Sources: []string{"/tmp/file"}, Destination: "instance-1:/tmp/file", Zone: "us-central1-a", Project: "project-1"}
+	cfg := defaultConfig()
+	if args := gcloudSSHArgs(&cfg, ar); hasArg(args, "--ssh-key-file") {
+		t.Fatalf("--ssh-key-file not expected in %v", args)
+	}
+
+	os.Setenv("GCLOUD_SSH_KEY_FILE", "/var/lib/awx/.ssh/gcloud-ssh")
+	os.Setenv("GCLOUD_SSH_FORCE_KEY_FILE_OVERWRITE", "true")
+	if err := cfg.applyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{gcloudSSHArgs(&cfg, ar), gcloudSCPArgs(&cfg, ar)} {
+		i := indexOf(args, "--ssh-key-file")
+		if i < 0 || args[i+1] != "/var/lib/awx/.ssh/gcloud-ssh" || !hasArg(args, "--force-key-file-overwrite") {
+			t.Fatalf("key file flags expected in %v", args)
+		}
+	}
+}
+
+func TestGCloudArgsSkipKeyPropagation(t *testing.T) {
+	defer os.Unsetenv("GCLOUD_SSH_SKIP_KEY_PROPAGATION")
+	ar := AnsibleRun{Command: "ls", Sources: []string{"/tmp/file"}, Destination: "instance-1:/tmp/file", Zone: "us-central1-a", Project: "project-1"}
+	os.Setenv("GCLOUD_SSH_SKIP_KEY_PROPAGATION", "true")
+	cfg := defaultConfig()
+	cfg.KeyFile = "/var/lib/awx/.ssh/gcloud-ssh"
+	if err := cfg.applyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	for flag, args := range map[string][]string{"--ssh-flag": gcloudSSHArgs(&cfg, ar), "--scp-flag": gcloudSCPArgs(&cfg, ar)} {
+		if !hasArg(args, "--plain") || !hasArg(args, flag+"=-i /var/lib/awx/.ssh/gcloud-ssh") || hasArg(args, "--ssh-key-file") {
+			t.Fatalf("plain key flags expected in %v", args)
+		}
+	}
+
+	// The host keys are still checked against the gcloud known hosts by
+	// instance ID, as gcloud does outside of plain mode
+	stubComputeService(t, func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(http.StatusOK, `{"items": {"zones/us-central1-a": {"instances": [
+			{"name": "instance-1", "id": "8226491541318462", "networkInterfaces": [{"networkIP": "172.16.0.11"}]}
+		]}}}`), nil
+	})
+	defer func(home string) { os.Setenv("HOME", home) }(os.Getenv("HOME"))
+	os.Setenv("HOME", "/var/lib/awx")
+	cfg.Projects, cfg.CacheTTL = []string{"project-1"}, 0
+	ar = AnsibleRun{Command: "ls", Sources: []string{"/tmp/file"}, Destination: "172.16.0.11:/tmp/file"}
+	if err := updateWithInstanceName(context.Background(), &cfg, nil, &ar); err != nil {
+		t.Fatal(err)
+	}
+	for flag, args := range map[string][]string{"--ssh-flag": gcloudSSHArgs(&cfg, ar), "--scp-flag": gcloudSCPArgs(&cfg, ar)} {
+		for _, expected := range []string{
+			flag + "=-o UserKnownHostsFile=/var/lib/awx/.ssh/google_compute_known_hosts",
+			flag + "=-o CheckHostIP=no",
+			flag + "=-o HostKeyAlias=compute.8226491541318462",
+		} {
+			if !hasArg(args, expected) {
+				t.Fatalf("'%v' expected in %v", expected, args)
+			}
+		}
+	}
+}
+
+func TestGCloudArgsInternalIP(t *testing.T) {
+	defer os.Unsetenv("GCLOUD_SSH_INTERNAL_IP")
+	defer os.Unsetenv("GCLOUD_SSH_USE_IAP")
+	ar := AnsibleRun{Command: "ls", Sources: []string{"/tmp/file"}, Destination: "instance-1:/tmp/file", Zone: "us-central1-a", Project: "project-1"}
+	os.Setenv("GCLOUD_SSH_INTERNAL_IP", "true")
+	cfg := defaultConfig()
+	if err := cfg.applyEnv(); err == nil || !strings.Contains(err.Error(), "GCLOUD_SSH_USE_IAP") {
+		t.Fatalf("IAP and internal IP error expected, found '%v'", err)
+	}
+
+	os.Setenv("GCLOUD_SSH_USE_IAP", "false")
+	cfg = defaultConfig()
+	if err := cfg.applyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{gcloudSSHArgs(&cfg, ar), gcloudSCPArgs(&cfg, ar)} {
+		if !hasArg(args, "--internal-ip") || hasArg(args, "--tunnel-through-iap") {
+			t.Fatalf("--internal-ip without --tunnel-through-iap expected in %v", args)
+		}
+	}
+	cfg.InternalIP = false
+	if args := gcloudSSHArgs(&cfg, ar); hasArg(args, "--internal-ip") {
+		t.Fatalf("--internal-ip not expected in %v", args)
+	}
+}
+
+func TestGCloudArgsConfiguration(t *testing.T) {
+	ar := AnsibleRun{Command: "ls", Sources: []string{"/tmp/file"}, Destination: "instance-1:/tmp/file", Zone: "us-central1-a", Project: "project-1"}
+	cfg := defaultConfig()
+	if args := gcloudSSHArgs(&cfg, ar); hasArg(args, "--configuration") || args[0] != "compute" {
+		t.Fatalf("the active configuration must be used, found %v", args)
+	}
+
+	cfg.GcloudConfig = "awx"
+	for _, args := range [][]string{gcloudSSHArgs(&cfg, ar), gcloudSCPArgs(&cfg, ar)} {
+		// Global flags come before the command group
+		if !reflect.DeepEqual(args[:3], []string{"--configuration", "awx", "compute"}) {
+			t.Fatalf("unexpected arguments order: %v", args)
+		}
+	}
+}
+
+func TestGCloudArgsOptions(t *testing.T) {
+	args, err := ParseCommandLine(`-C -o ControlMaster=auto -o PreferredAuthentications=gssapi-with-mic,gssapi-keyex,hostbased,publickey -o User=foo -o "ProxyCommand=nc %h %p" 172.16.0.12 ls`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := ParseAnsibleArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := defaultConfig()
+	sshArgs := gcloudSSHArgs(&cfg, a)
+	for _, expected := range []string{
+		"--ssh-flag=-o ControlMaster=auto",
+		"--ssh-flag=-o PreferredAuthentications=gssapi-with-mic,gssapi-keyex,hostbased,publickey",
+		"--ssh-flag=-o User=foo",
+		`--ssh-flag=-o ProxyCommand="nc %h %p"`,
+	} {
+		if !hasArg(sshArgs, expected) {
+			t.Fatalf("'%v' expected in %v", expected, sshArgs)
+		}
+	}
+
+	if scpArgs := gcloudSCPArgs(&cfg, a); !hasArg(scpArgs, "--scp-flag=-o User=foo") {
+		t.Fatalf("'%v' expected in %v", "--scp-flag=-o User=foo", scpArgs)
+	}
+}
+
+func TestGCloudArgsControlOptions(t *testing.T) {
+	args, err := ParseCommandLine(`-C -o ControlMaster=auto -o ControlPersist=60s -o ControlPath=/tmp/awx_2826_wrtrtczl/cp/3c85463f3f 172.16.0.12 ls`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := ParseAnsibleArgs(append([]string{"ssh"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := defaultConfig()
+	sshArgs := gcloudSSHArgs(&cfg, a)
+	for _, expected := range []string{
+		"--ssh-flag=-o ControlMaster=auto",
+		"--ssh-flag=-o ControlPersist=60s",
+		"--ssh-flag=-o ControlPath=/tmp/awx_2826_wrtrtczl/cp/3c85463f3f",
+	} {
+		if !hasArg(sshArgs, expected) {
+			t.Fatalf("'%v' expected in %v", expected, sshArgs)
+		}
+	}
+
+	// Only the Control options are stripped
+	defer os.Unsetenv("GCLOUD_SSH_STRIP_CONTROL")
+	os.Setenv("GCLOUD_SSH_STRIP_CONTROL", "true")
+	if err := cfg.applyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	a.Options = append(a.Options, "User=andy")
+	for _, args := range [][]string{gcloudSSHArgs(&cfg, a), gcloudSCPArgs(&cfg, a)} {
+		for _, arg := range args {
+			if strings.Contains(arg, "-o Control") {
+				t.Fatalf("'%v' not expected in %v", arg, args)
+			}
+		}
+		if !hasArg(args, "--ssh-flag=-o User=andy") && !hasArg(args, "--scp-flag=-o User=andy") {
+			t.Fatalf("User option expected in %v", args)
+		}
+	}
+}
+
+func TestGCloudArgsExtra(t *testing.T) {
+	os.Setenv("GCLOUD_SSH_EXTRA_ARGS", `--verbosity=debug,--internal-ip "--ssh-key-expire-after=1h"`)
+	defer os.Unsetenv("GCLOUD_SSH_EXTRA_ARGS")
+	cfg := defaultConfig()
+	if err := cfg.applyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	extraArgs := []string{"--verbosity=debug", "--internal-ip", "--ssh-key-expire-after=1h"}
+	if !reflect.DeepEqual(cfg.ExtraArgs, extraArgs) {
+		t.Fatalf("'%v' != '%v'", cfg.ExtraArgs, extraArgs)
+	}
+
+	ar := AnsibleRun{Command: "ls", Sources: []string{"/tmp/file"}, Destination: "instance-1:/tmp/file", Zone: "us-central1-a", Project: "project-1"}
+	for _, args := range [][]string{gcloudSSHArgs(&cfg, ar), gcloudSCPArgs(&cfg, ar)} {
+		// The extra flags come before the positional arguments
+		index := indexOf(args, "--project")
+		if index < len(extraArgs) || !reflect.DeepEqual(args[index-len(extraArgs):index], extraArgs) {
+			t.Fatalf("extra args expected before --project in %v", args)
+		}
+	}
+
+	os.Setenv("GCLOUD_SSH_EXTRA_ARGS", `--verbosity="debug`)
+	if err := cfg.applyEnv(); err == nil {
+		t.Fatal("unclosed quote error expected")
+	}
+}
+
+func TestGCloudArgsUser(t *testing.T) {
+	cfg := defaultConfig()
+
+	// Without User option gcloud picks the user
+	a, err := ParseAnsibleArgs([]string{"ssh", "-o", "ConnectTimeout=10", "172.16.0.11", "ls"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Destination = replaceIP(a.Destination, "172.16.0.11", "instance-1")
+	if args := gcloudSSHArgs(&cfg, a); !hasArg(args, "instance-1") {
+		t.Fatalf("'%v' expected in %v", "instance-1", args)
+	}
+
+	a, err = ParseAnsibleArgs([]string{"ssh", "-o", `User="andy_retailnext_net"`, "172.16.0.11", "ls"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Destination = replaceIP(a.Destination, "172.16.0.11", "instance-1")
+	if args := gcloudSSHArgs(&cfg, a); !hasArg(args, "andy_retailnext_net@instance-1") {
+		t.Fatalf("'%v' expected in %v", "andy_retailnext_net@instance-1", args)
+	}
+
+	a, err = ParseAnsibleSCP([]string{"scp", "-o", "User=sa_111069622966946909314", "/tmp/file", "[172.16.0.11]:/tmp/file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Destination = replaceIP(a.Destination, "172.16.0.11", "instance-1")
+	if args := gcloudSCPArgs(&cfg, a); !hasArg(args, "sa_111069622966946909314@instance-1:/tmp/file") {
+		t.Fatalf("'%v' expected in %v", "sa_111069622966946909314@instance-1:/tmp/file", args)
+	}
+}
+
+func TestSCPRecursive(t *testing.T) {
+	cfg := defaultConfig()
+	a, err := ParseAnsibleSCP([]string{"scp", "-C", "-r", "/tmp/dir", "[172.16.0.11]:/tmp/dir"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Recursive {
+		t.Fatal("recursive copy expected")
+	}
+	if args := gcloudSCPArgs(&cfg, a); !hasArg(args, "--recurse") {
+		t.Fatalf("'%v' expected in %v", "--recurse", args)
+	}
+
+	a, err = ParseAnsibleSCP([]string{"scp", "-C", "/tmp/file", "[172.16.0.11]:/tmp/file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := gcloudSCPArgs(&cfg, a); a.Recursive || hasArg(args, "--recurse") {
+		t.Fatalf("'%v' not expected in %v", "--recurse", args)
+	}
+}
+
+func TestSCPLimitCompress(t *testing.T) {
+	cfg := defaultConfig()
+	a, err := ParseAnsibleSCP([]string{"scp", "-C", "-l", "8192", "/tmp/file", "[172.16.0.11]:/tmp/file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Compress || a.Limit != "8192" {
+		t.Fatalf("unexpected flags: %v %v", a.Compress, a.Limit)
+	}
+	// The limit value is not a source
+	if len(a.Sources) != 1 || a.Sources[0] != "/tmp/file" {
+		t.Fatalf("'%v' != '%v'", a.Sources, []string{"/tmp/file"})
+	}
+	args := gcloudSCPArgs(&cfg, a)
+	for _, arg := range []string{"--scp-flag=-C", "--scp-flag=-l8192"} {
+		if !hasArg(args, arg) {
+			t.Fatalf("'%v' expected in %v", arg, args)
+		}
+	}
+
+	a, err = ParseAnsibleSCP([]string{"scp", "-l1024", "/tmp/file", "[172.16.0.11]:/tmp/file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args = gcloudSCPArgs(&cfg, a)
+	if !hasArg(args, "--scp-flag=-l1024") || hasArg(args, "--scp-flag=-C") {
+		t.Fatalf("unexpected flags in %v", args)
+	}
+}
+
+func TestSCPDirection(t *testing.T) {
+	cfg := defaultConfig()
+	a, err := ParseAnsibleSCP([]string{"scp", "-o", "User=foo", "/tmp/local", "[172.16.0.11]:/tmp/remote"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Download {
+		t.Fatal("upload expected")
+	}
+	a.Destination = replaceIP(a.Destination, ExtractIP(a.Destination), "instance-1")
+	args := gcloudSCPArgs(&cfg, a)
+	if args[len(args)-2] != "/tmp/local" || args[len(args)-1] != "foo@instance-1:/tmp/remote" {
+		t.Fatalf("unexpected upload args %v", args)
+	}
+
+	a, err = ParseAnsibleSCP([]string{"scp", "-o", "User=foo", "[172.16.0.11]:/tmp/remote", "/tmp/local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Download {
+		t.Fatal("download expected")
+	}
+	a.Sources[0] = replaceIP(a.Sources[0], ExtractIP(a.Sources[0]), "instance-1")
+	args = gcloudSCPArgs(&cfg, a)
+	if args[len(args)-2] != "foo@instance-1:/tmp/remote" || args[len(args)-1] != "/tmp/local" {
+		t.Fatalf("unexpected download args %v", args)
+	}
+
+	for _, source := range []string{"172.16.0.11:/tmp/remote", "instance-1:/tmp/remote", "andy@instance-1:/tmp/remote", "host.example.com:/tmp/remote", "andy@vm-1.us-central1-a.c.project-1.internal:/tmp/remote"} {
+		a, err = ParseAnsibleSCP([]string{"scp", source, "/tmp/local"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !a.Download {
+			t.Fatalf("%v: download expected", source)
+		}
+	}
+	// Paths before the colon are local
+	a, err = ParseAnsibleSCP([]string{"scp", "./local:file", "instance-1:/tmp/remote"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Download {
+		t.Fatal("upload expected")
+	}
+}
+
+func TestUserAtHost(t *testing.T) {
+	cfg := defaultConfig()
+	a, err := ParseAnsibleArgs([]string{"ssh", "-o", "User=bar", "foo@172.16.0.11", "ls"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := ExtractIP(a.Destination); ip != "172.16.0.11" {
+		t.Fatalf("'%v' != '%v'", ip, "172.16.0.11")
+	}
+	a.Destination = replaceIP(a.Destination, "172.16.0.11", "instance-1")
+	if args := gcloudSSHArgs(&cfg, a); !hasArg(args, "foo@instance-1") {
+		t.Fatalf("'%v' expected in %v", "foo@instance-1", args)
+	}
+
+	for target, expected := range map[string]string{
+		"foo@[172.16.0.11]:/tmp/file": "foo@instance-1:/tmp/file",
+		"foo@172.16.0.11:/tmp/file":   "foo@instance-1:/tmp/file",
+	} {
+		a, err = ParseAnsibleSCP([]string{"scp", target, "/tmp/file"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !a.Download {
+			t.Fatalf("%v: download expected", target)
+		}
+		if ip := ExtractIP(a.Sources[0]); ip != "172.16.0.11" {
+			t.Fatalf("'%v' != '%v'", ip, "172.16.0.11")
+		}
+		a.Sources[0] = replaceIP(a.Sources[0], "172.16.0.11", "instance-1")
+		if args := gcloudSCPArgs(&cfg, a); !hasArg(args, expected) {
+			t.Fatalf("'%v' expected in %v", expected, args)
+		}
+	}
+
+	// Local paths with an @ are not remote
+	if isRemote("/tmp/foo@bar:baz") {
+		t.Fatal("local path expected")
+	}
+}
+
+func TestPort(t *testing.T) {
+	cfg := defaultConfig()
+	for _, args := range [][]string{
+		{"ssh", "[172.16.0.12]:2222", "ls"},
+		{"ssh", "-p", "2222", "172.16.0.12", "ls"},
+		{"ssh", "-p2222", "172.16.0.12", "ls"},
+	} {
+		a, err := ParseAnsibleArgs(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Port != "2222" || ExtractIP(a.Destination) != "172.16.0.12" {
+			t.Fatalf("%v: unexpected port %v and destination %v", args, a.Port, a.Destination)
+		}
+		a.Destination = replaceIP(a.Destination, "172.16.0.12", "instance-1")
+		if sshArgs := gcloudSSHArgs(&cfg, a); !hasArg(sshArgs, "--ssh-flag=-p2222") || !hasArg(sshArgs, "instance-1") {
+			t.Fatalf("'%v' expected in %v", "--ssh-flag=-p2222", sshArgs)
+		}
+	}
+
+	a, err := ParseAnsibleSCP([]string{"scp", "-P", "2222", "/tmp/file", "[172.16.0.12]:/tmp/file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := gcloudSCPArgs(&cfg, a); a.Port != "2222" || !hasArg(args, "--scp-flag=-P2222") {
+		t.Fatalf("'%v' expected in %v", "--scp-flag=-P2222", args)
+	}
+
+	// Without port no flag is added
+	a, err = ParseAnsibleArgs([]string{"ssh", "172.16.0.12", "ls"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, arg := range gcloudSSHArgs(&cfg, a) {
+		if strings.HasPrefix(arg, "--ssh-flag=-p") {
+			t.Fatalf("port flag not expected, found '%v'", arg)
+		}
+	}
+}
+
+func TestSCPMultipleSources(t *testing.T) {
+	cfg := defaultConfig()
+	a, err := ParseAnsibleSCP([]string{"scp", "-o", "User=foo", "/tmp/a", "/tmp/b", "/tmp/c", "[172.16.0.11]:/tmp/dir/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a.Sources, []string{"/tmp/a", "/tmp/b", "/tmp/c"}) {
+		t.Fatalf("unexpected sources: %v", a.Sources)
+	}
+	a.Destination = replaceIP(a.Destination, ExtractIP(a.Destination), "instance-1")
+	args := gcloudSCPArgs(&cfg, a)
+	expected := []string{"/tmp/a", "/tmp/b", "/tmp/c", "foo@instance-1:/tmp/dir/"}
+	if !reflect.DeepEqual(args[len(args)-4:], expected) {
+		t.Fatalf("unexpected args %v", args)
+	}
+
+	a, err = ParseAnsibleSCP([]string{"scp", "[172.16.0.11]:/tmp/a", "[172.16.0.12]:/tmp/b", "/tmp/dir/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := updateWithInstanceName(context.Background(), &cfg, nil, &a); err == nil || !strings.Contains(err.Error(), "different hosts") {
+		t.Fatalf("different hosts error expected, found '%v'", err)
+	}
+}
+
+func TestUpdateWithInstanceNameNotIP(t *testing.T) {
+	cfg := defaultConfig()
+	for _, destination := range []string{"Not_An_Instance", "", "[host_1.example.com]:/tmp/file"} {
+		a := AnsibleRun{Destination: destination}
+		err := updateWithInstanceName(context.Background(), &cfg, nil, &a)
+		if err == nil || !strings.Contains(err.Error(), "not an IP") {
+			t.Fatalf("%v: not an IP error expected, found '%v'", destination, err)
+		}
+	}
+}
+
+func TestFindInstanceByName(t *testing.T) {
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		filter := req.URL.Query().Get("filter")
+		if filter != "(status = RUNNING) AND (name = instance-1)" {
+			t.Fatalf("unexpected filter: %v", filter)
+		}
+		return jsonResponse(http.StatusOK, aggregatedListResponse), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1"}, MaxRetries: 4, Concurrency: 8}
+	instanceName, zone, project, err := findInstanceByName(context.Background(), computeService, cfg, "instance-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instanceName != "instance-1" || zone != "us-central1-a" || project != "project-1" {
+		t.Fatalf("unexpected instance: %v %v %v", instanceName, zone, project)
+	}
+
+	_, _, _, err = findInstanceByName(context.Background(), newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(http.StatusOK, aggregatedListResponse), nil
+	}), cfg, "instance-2")
+	if err == nil {
+		t.Fatal("not found error expected")
+	}
+}
+
+func TestStatusFilter(t *testing.T) {
+	for _, test := range []struct {
+		statuses []string
+		filter   string
+	}{
+		{nil, "(status = RUNNING)"},
+		{[]string{"RUNNING"}, "(status = RUNNING)"},
+		{[]string{"RUNNING", " repairing", "STOPPING"}, "((status = RUNNING) OR (status = REPAIRING) OR (status = STOPPING))"},
+		{[]string{"ALL"}, ""},
+	} {
+		if filter := statusFilter(test.statuses); filter != test.filter {
+			t.Fatalf("'%v' != '%v'", filter, test.filter)
+		}
+	}
+
+	if filter := joinFilters(statusFilter([]string{"RUNNING", "STOPPING"}), "(name = instance-1)"); filter != "((status = RUNNING) OR (status = STOPPING)) AND (name = instance-1)" {
+		t.Fatalf("unexpected filter: %v", filter)
+	}
+	if filter := joinFilters(statusFilter([]string{"ALL"}), "(name = instance-1)"); filter != "(name = instance-1)" {
+		t.Fatalf("unexpected filter: %v", filter)
+	}
+}
+
+func TestLabelFilter(t *testing.T) {
+	cfg := &Config{StatusFilter: []string{"RUNNING"}, LabelFilter: "ansible-managed=true"}
+	if filter := instanceFilter(cfg); filter != "(status = RUNNING) AND (labels.ansible-managed = true)" {
+		t.Fatalf("unexpected filter: %v", filter)
+	}
+	cfg.LabelFilter = ""
+	if filter := instanceFilter(cfg); filter != "(status = RUNNING)" {
+		t.Fatalf("unexpected filter: %v", filter)
+	}
+
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		filter := req.URL.Query().Get("filter")
+		if filter != "(status = RUNNING) AND (labels.ansible-managed = true)" {
+			t.Fatalf("unexpected filter: %v", filter)
+		}
+		return jsonResponse(http.StatusOK, aggregatedListResponse), nil
+	})
+	cfg = &Config{Projects: []string{"project-1"}, LabelFilter: "ansible-managed=true", MaxRetries: 4, Concurrency: 1}
+	if _, _, _, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, label := range []string{"ansible-managed", "=true", "ansible-managed="} {
+		if _, err := labelFilter(label); err == nil {
+			t.Fatalf("%v: invalid label filter error expected", label)
+		}
+	}
+}
+
+func TestInstanceFilter(t *testing.T) {
+	cfg := &Config{StatusFilter: []string{"RUNNING"}, InstanceFilter: ` machineType eq ".*/e2-small" OR (tags.items = iap-ssh) `}
+	expected := `(status = RUNNING) AND (machineType eq ".*/e2-small" OR (tags.items = iap-ssh))`
+	if filter := instanceFilter(cfg); filter != expected {
+		t.Fatalf("'%v' != '%v'", filter, expected)
+	}
+	cfg.LabelFilter = "ansible-managed=true"
+	expected = `(status = RUNNING) AND (labels.ansible-managed = true) AND (machineType eq ".*/e2-small" OR (tags.items = iap-ssh))`
+	if filter := instanceFilter(cfg); filter != expected {
+		t.Fatalf("'%v' != '%v'", filter, expected)
+	}
+	cfg.StatusFilter, cfg.LabelFilter = []string{"ALL"}, ""
+	if filter := instanceFilter(cfg); filter != `(machineType eq ".*/e2-small" OR (tags.items = iap-ssh))` {
+		t.Fatalf("unexpected filter: %v", filter)
+	}
+
+	for _, expression := range []string{"(tags.items = iap-ssh", "tags.items = iap-ssh)", ") OR (", `name = "instance-1`} {
+		if _, err := expressionFilter(expression); err == nil {
+			t.Fatalf("%v: invalid instance filter error expected", expression)
+		}
+	}
+	if filter, err := expressionFilter(`name = "instance-(1"`); err != nil || filter != `(name = "instance-(1")` {
+		t.Fatalf("unexpected filter: %v %v", filter, err)
+	}
+
+	defer os.Unsetenv("GCLOUD_SSH_INSTANCE_FILTER")
+	os.Setenv("GCLOUD_SSH_INSTANCE_FILTER", " ")
+	empty := defaultConfig()
+	if err := empty.applyEnv(); err == nil {
+		t.Fatal("empty instance filter error expected")
+	}
+}
+
+func TestIsInstanceName(t *testing.T) {
+	for _, name := range []string{"instance-1", "a", "awx-managed-1"} {
+		if !isInstanceName(name) {
+			t.Fatalf("%v must be an instance name", name)
+		}
+	}
+	for _, name := range []string{"", "Instance-1", "1-instance", "instance-", "host.example.com", "172.16.0.11"} {
+		if isInstanceName(name) {
+			t.Fatalf("%v must not be an instance name", name)
+		}
+	}
+}
+
+func TestIsVersionRequest(t *testing.T) {
+	for _, args := range [][]string{{"ssh", "--version"}, {"ssh", "version"}} {
+		if !isVersionRequest(args) {
+			t.Fatalf("%v must be a version request", args)
+		}
+	}
+	for _, args := range [][]string{{"ssh"}, {"ssh", "-C", "172.16.0.11", "version"}, {"scp", "/tmp/version", "[172.16.0.11]:/tmp/version"}} {
+		if isVersionRequest(args) {
+			t.Fatalf("%v must not be a version request", args)
+		}
+	}
+}
+
+func TestIsSCPInvocation(t *testing.T) {
+	for _, test := range []struct {
+		argv0    string
+		doSCP    bool
+		expected bool
+	}{
+		{"scp", false, true},
+		{"/usr/local/bin/scp", false, true},
+		{"/opt/awx/bin/gcloud-scp", false, true},
+		{"ssh", true, false},
+		{"/usr/local/bin/ssh", true, false},
+		// The wrapper own name and others leave it to DO_SCP
+		{"/usr/local/bin/gcloud-ssh", true, true},
+		{"/usr/local/bin/gcloud-ssh", false, false},
+		{"./wrapper", true, true},
+		{"./wrapper", false, false},
+	} {
+		if isSCPInvocation(test.argv0, test.doSCP) != test.expected {
+			t.Fatalf("%v with DO_SCP %v: '%v' != '%v'", test.argv0, test.doSCP, !test.expected, test.expected)
+		}
+	}
+}
+
+func TestSetupLoggerUnwritable(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+
+	cfg := defaultConfig()
+	cfg.LogFile = "/nonexistent/gcloud-ssh/gcloud-ssh.log"
+	closeLogger := setupLogger(&cfg)
+	defer closeLogger()
+	if log.Writer() != os.Stderr {
+		t.Fatal("logs must fall back to stderr")
+	}
+
+	cfg.LogFile = ""
+	closeLogger = setupLogger(&cfg)
+	defer closeLogger()
+	if log.Writer() != os.Stderr {
+		t.Fatal("logs must go to stderr")
+	}
+}
+
+func TestRunGCloudKeepsCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcloud-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := defaultConfig()
+	cache := newResolutionCache(dir, time.Minute, &cfg)
+	ansible := AnsibleRun{Command: "false", Destination: "instance-1", Host: "172.16.0.11"}
+	for code, cached := range map[int]bool{1: true, 255: false} {
+		cache.Put("172.16.0.11", cacheEntry{Instance: "instance-1", Zone: "us-central1-a", Project: "project-1"})
+		failure := exec.Command("sh", "-c", fmt.Sprintf("exit %d", code)).Run()
+		run := func(cfg *Config, ar AnsibleRun) error { return failure }
+		runGCloud(&cfg, cache, "ssh", run, ansible, ansible)
+		// Only the connection failures drop the resolution, not the command ones
+		if _, ok := cache.Get("172.16.0.11"); ok != cached {
+			t.Fatalf("exit %v: '%v' != '%v'", code, ok, cached)
+		}
+	}
+}
+
+func TestRunGCloudReresolve(t *testing.T) {
+	stubComputeService(t, func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(http.StatusOK, `{"items": {"zones/us-central1-a": {"instances": [
+			{"name": "instance-2", "scheduling": {"preemptible": true}, "networkInterfaces": [{"networkIP": "172.16.0.11"}]}
+		]}}}`), nil
+	})
+	connectionFailure := exec.Command("sh", "-c", "exit 255").Run()
+
+	dir, err := ioutil.TempDir("", "gcloud-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := newResolutionCache(dir, time.Minute, &Config{})
+
+	cfg := defaultConfig()
+	cfg.Projects = []string{"project-1"}
+	for _, reresolve := range []bool{true, false} {
+		cfg.ReresolveOnFail = reresolve
+		// The instance was recreated by another name since it was cached
+		cache.Put("172.16.0.11", cacheEntry{Instance: "instance-1", Zone: "us-central1-a", Project: "project-1", Preemptible: true})
+		unresolved := AnsibleRun{Command: "ls", Destination: "172.16.0.11"}
+		ansible := unresolved.clone()
+		if err := updateWithInstanceName(context.Background(), &cfg, cache, &ansible); err != nil {
+			t.Fatal(err)
+		}
+
+		var destinations []string
+		run := func(cfg *Config, ar AnsibleRun) error {
+			destinations = append(destinations, ar.Destination)
+			if ar.Destination == "instance-1" {
+				return connectionFailure
+			}
+			return nil
+		}
+		err := runGCloud(&cfg, cache, "ssh", run, unresolved, ansible)
+		if reresolve {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(destinations, []string{"instance-1", "instance-2"}) {
+				t.Fatalf("unexpected runs: %v", destinations)
+			}
+			if entry, ok := cache.Get("172.16.0.11"); !ok || entry.Instance != "instance-2" {
+				t.Fatalf("unexpected cache entry: %v %v", entry, ok)
+			}
+		} else {
+			if exitCode(err) != exitCodeFailure {
+				t.Fatalf("'%v' != '%v'", exitCode(err), exitCodeFailure)
+			}
+			if !reflect.DeepEqual(destinations, []string{"instance-1"}) {
+				t.Fatalf("unexpected runs: %v", destinations)
+			}
+			if _, ok := cache.Get("172.16.0.11"); ok {
+				t.Fatal("failed resolution must be invalidated")
+			}
+		}
+	}
+}
+
+func TestRunGCloudCanceled(t *testing.T) {
+	stubComputeService(t, func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(http.StatusOK, `{"items": {"zones/us-central1-a": {"instances": [
+			{"name": "instance-2", "scheduling": {"preemptible": true}, "networkInterfaces": [{"networkIP": "172.16.0.11"}]}
+		]}}}`), nil
+	})
+
+	dir, err := ioutil.TempDir("", "gcloud-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := newResolutionCache(dir, time.Minute, &Config{})
+
+	cfg := defaultConfig()
+	cfg.Projects = []string{"project-1"}
+	for name, failure := range map[string]func() error{
+		// The job is canceled, the wrapper forwards the signal to gcloud
+		"canceled": func() error {
+			return runCommand(exec.Command("sh", "-c", "kill -TERM $PPID; sleep 10 & wait"), 0)
+		},
+		"timed out": func() error {
+			return runCommand(exec.Command("sleep", "10"), 10*time.Millisecond)
+		},
+		"killed": func() error {
+			return exec.Command("sh", "-c", "kill -KILL $$").Run()
+		},
+		"not started": func() error {
+			return exec.Command(filepath.Join(dir, "gcloud")).Run()
+		},
+	} {
+		cache.Put("172.16.0.11", cacheEntry{Instance: "instance-1", Zone: "us-central1-a", Project: "project-1", Preemptible: true})
+		unresolved := AnsibleRun{Command: "ls", Destination: "172.16.0.11"}
+		ansible := unresolved.clone()
+		if err := updateWithInstanceName(context.Background(), &cfg, cache, &ansible); err != nil {
+			t.Fatal(err)
+		}
+
+		var destinations []string
+		run := func(cfg *Config, ar AnsibleRun) error {
+			destinations = append(destinations, ar.Destination)
+			return failure()
+		}
+		if err := runGCloud(&cfg, cache, "ssh", run, unresolved, ansible); err == nil {
+			t.Fatalf("%s: error expected", name)
+		}
+		// gcloud is not run again, the instance it didn't connect to is kept
+		if !reflect.DeepEqual(destinations, []string{"instance-1"}) {
+			t.Fatalf("%s: unexpected runs: %v", name, destinations)
+		}
+		if entry, ok := cache.Get("172.16.0.11"); !ok || entry.Instance != "instance-1" {
+			t.Fatalf("%s: unexpected cache entry: %v %v", name, entry, ok)
+		}
+	}
+}
+
+func TestLogTiming(t *testing.T) {
+	defer func(original *Logger) { logger = original }(logger)
+	var buf bytes.Buffer
+	logger = &Logger{out: &buf, mu: &sync.Mutex{}}
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(http.StatusOK, aggregatedListResponse), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1"}, MaxRetries: 4, Concurrency: 1}
+	if _, _, _, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "Timing:") {
+		t.Fatalf("timing logged while disabled: %v", buf.String())
+	}
+
+	cfg.LogTiming = true
+	if _, _, _, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11"); err != nil {
+		t.Fatal(err)
+	}
+	for _, phase := range []string{"Timing: zone listing took ", "Timing: instance listing took "} {
+		if !strings.Contains(buf.String(), phase) {
+			t.Fatalf("%q expected in %v", phase, buf.String())
+		}
+	}
+}
+
+func TestRunErrorOutput(t *testing.T) {
+	stubComputeService(t, func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(http.StatusOK, aggregatedListResponse), nil
+	})
+	defer func(args []string) { os.Args = args }(os.Args)
+	os.Args = []string{"ssh", "-o", "User=andy", "172.16.0.99", "/bin/sh -c 'echo ~andy && sleep 0'"}
+	for key, value := range map[string]string{
+		"GCLOUD_SSH_CONFIG":    "/nonexistent/gcloud-ssh.yaml",
+		"GCLOUD_SSH_PROJECTS":  "project-1",
+		"GCLOUD_SSH_LOG_FILE":  "",
+		"GCLOUD_SSH_CACHE_TTL": "0s",
+	} {
+		defer os.Unsetenv(key)
+		os.Setenv(key, value)
+	}
+
+	defer func(original io.Writer) { errOut = original }(errOut)
+	var stderr bytes.Buffer
+	errOut = &stderr
+	defer func(original *os.File) { os.Stdout = original }(os.Stdout)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+
+	code := run()
+	w.Close()
+	stdout, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != exitCodeFailure {
+		t.Fatalf("'%v' != '%v'", code, exitCodeFailure)
+	}
+	// Ansible reads stdout as the command output
+	if len(stdout) != 0 {
+		t.Fatalf("stdout must stay clean, found '%s'", stdout)
+	}
+	if expected := "gcloud-ssh: Not found networkIP: 172.16.0.99\n"; stderr.String() != expected {
+		t.Fatalf("'%v' != '%v'", stderr.String(), expected)
+	}
+}
+
+func TestRunConfigErrorLogged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcloud-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(args []string) { os.Args = args }(os.Args)
+	os.Args = []string{"ssh", "-o", "User=andy", "172.16.0.11", "ls"}
+	defer func(original io.Writer) { errOut = original }(errOut)
+	errOut = ioutil.Discard
+	defer logger.configure("text", "debug")
+
+	for key, value := range map[string]string{
+		"GCLOUD_SSH_MAX_RETRIES": "many",
+		"GCLOUD_SSH_LOG_LEVEL":   "verbose",
+	} {
+		logFile := filepath.Join(dir, key+".log")
+		for k, v := range map[string]string{"GCLOUD_SSH_CONFIG": "/nonexistent/gcloud-ssh.yaml", "GCLOUD_SSH_LOG_FILE": logFile, key: value} {
+			defer os.Unsetenv(k)
+			os.Setenv(k, v)
+		}
+		if code := run(); code != exitCodeConfig {
+			t.Fatalf("'%v' != '%v'", code, exitCodeConfig)
+		}
+		os.Unsetenv(key)
+
+		// The failure reached the log file before the exit
+		data, err := ioutil.ReadFile(logFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "Invalid configuration") || !strings.Contains(string(data), value) {
+			t.Fatalf("%v: configuration error expected in the log, found '%s'", key, data)
+		}
+	}
+}
+
+func TestUpdateWithZoneOverride(t *testing.T) {
+	var paths []string
+	stubComputeService(t, func(req *http.Request) (*http.Response, error) {
+		paths = append(paths, req.URL.Path)
+		return jsonResponse(http.StatusOK, `{"items": [{"name": "instance-1", "networkInterfaces": [{"networkIP": "172.16.0.11"}]}]}`), nil
+	})
+	defer os.Unsetenv("GCLOUD_SSH_ZONE")
+	defer os.Unsetenv("GCLOUD_SSH_PROJECT")
+	os.Setenv("GCLOUD_SSH_ZONE", "us-central1-b")
+	cfg := defaultConfig()
+	if err := cfg.applyEnv(); err == nil {
+		t.Fatal("zone without project error expected")
+	}
+	os.Setenv("GCLOUD_SSH_PROJECT", "project-2")
+	if err := cfg.applyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Projects = []string{"project-1"}
+
+	// Instance names go straight to gcloud
+	a := AnsibleRun{Destination: "andy@instance-1"}
+	if err := updateWithInstanceName(context.Background(), &cfg, nil, &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Destination != "andy@instance-1" || a.Zone != "us-central1-b" || a.Project != "project-2" {
+		t.Fatalf("unexpected resolution: %v %v %v", a.Destination, a.Zone, a.Project)
+	}
+	if len(paths) != 0 {
+		t.Fatalf("unexpected compute API calls: %v", paths)
+	}
+
+	// IPs are only searched in the zone
+	a = AnsibleRun{Destination: "172.16.0.11"}
+	if err := updateWithInstanceName(context.Background(), &cfg, nil, &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Destination != "instance-1" || a.Zone != "us-central1-b" || a.Project != "project-2" {
+		t.Fatalf("unexpected resolution: %v %v %v", a.Destination, a.Zone, a.Project)
+	}
+	if !reflect.DeepEqual(paths, []string{"/compute/v1/projects/project-2/zones/us-central1-b/instances"}) {
+		t.Fatalf("unexpected compute API calls: %v", paths)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// osLoginUsernameRegexp matches the characters replaced in the OS Login
+// usernames derived from the account emails
+var osLoginUsernameRegexp = regexp.MustCompile(`[^a-z0-9]`)
+
+// activeGCloudAccount gets the account gcloud runs as, replaced in tests. It
+// is read from the gcloud configuration when set there, otherwise gcloud is
+// asked once per cache TTL as it takes a while to start for each ansible task.
+var activeGCloudAccount = func(cfg *Config) (string, error) {
+	if account := gcloudConfigAccount(cfg); account != "" {
+		return account, nil
+	}
+	cache := newResolutionCache(cfg.CacheDir, cfg.CacheTTL, cfg)
+	key := "accounts/" + cfg.GcloudConfig
+	if entry, ok := cache.Get(key); ok && entry.Account != "" {
+		return entry.Account, nil
+	}
+	gcloud, err := findBinary(cfg.GcloudPath, "GCLOUD_SSH_GCLOUD_BIN")
+	if err != nil {
+		return "", err
+	}
+	args := append(gcloudGlobalFlags(cfg), "config", "get-value", "account")
+	out, err := exec.Command(gcloud, args...).Output()
+	account := strings.TrimSpace(string(out))
+	if err == nil && account != "" {
+		cache.Put(key, cacheEntry{Account: account})
+	}
+	return account, err
+}
+
+// Gets the account of the gcloud configuration used by the wrapper, from the
+// environment or its configuration file, empty when set in neither
+func gcloudConfigAccount(cfg *Config) string {
+	if account := os.Getenv("CLOUDSDK_CORE_ACCOUNT"); account != "" {
+		return account
+	}
+	dir := os.Getenv("CLOUDSDK_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config", "gcloud")
+	}
+	name := cfg.GcloudConfig
+	if name == "" {
+		name = os.Getenv("CLOUDSDK_ACTIVE_CONFIG_NAME")
+	}
+	if name == "" {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "active_config"))
+		name = strings.TrimSpace(string(data))
+	}
+	if name == "" {
+		name = "default"
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "configurations", "config_"+name))
+	if err != nil {
+		return ""
+	}
+	// The configurations are INI files, the account is in the core section
+	section := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if i := strings.IndexAny(line, "=:"); section == "core" && i > 0 && strings.TrimSpace(line[:i]) == "account" {
+			return strings.TrimSpace(line[i+1:])
+		}
+	}
+	return ""
+}
+
+// Gets the user the ssh and scp targets are prefixed with. With OS Login
+// gcloud logins with the username of its active account instead.
+func loginUser(cfg *Config, ar AnsibleRun) string {
+	if cfg.OSLogin {
+		return ""
+	}
+	return ar.User()
+}
+
+// Gets the OS Login username of a user account, like andy_retailnext_net for
+// andy@retailnext.net
+func osLoginUsername(account string) string {
+	return osLoginUsernameRegexp.ReplaceAllString(strings.ToLower(account), "_")
+}
+
+// Warns when the user ansible logins as is not the OS Login username of the
+// gcloud active account, the connection then runs as another user
+func checkOSLoginUser(cfg *Config, ar AnsibleRun) {
+	user := ar.User()
+	if !cfg.OSLogin || user == "" {
+		return
+	}
+	account, err := activeGCloudAccount(cfg)
+	if err != nil {
+		logger.Warnf("Cannot get the gcloud active account to check the OS Login user %s: %v", user, err)
+		return
+	}
+	if strings.HasSuffix(account, ".gserviceaccount.com") && strings.HasPrefix(user, "sa_") {
+		// Service account usernames are made of their unique ID
+		return
+	}
+	if username := osLoginUsername(account); username != user {
+		logger.Warnf("Connecting with OS Login as %s of the gcloud account %s instead of the user %s", username, account, user)
+	}
+}
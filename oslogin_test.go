@@ -0,0 +1,116 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestOSLoginUser(t *testing.T) {
+	defer func(original *Logger) { logger = original }(logger)
+	var buf bytes.Buffer
+	logger = &Logger{out: &buf, mu: &sync.Mutex{}}
+	defer func(original func(*Config) (string, error)) { activeGCloudAccount = original }(activeGCloudAccount)
+	activeGCloudAccount = func(cfg *Config) (string, error) {
+		return "andy@retailnext.net", nil
+	}
+
+	cfg := defaultConfig()
+	cfg.OSLogin = true
+	ar := AnsibleRun{Destination: "instance-1", Zone: "us-central1-a", Project: "project-1", Command: "ls", Options: []string{"User=andy_retailnext_net"}}
+	// The destination is left to gcloud
+	if args := gcloudSSHArgs(&cfg, ar); !hasArg(args, "instance-1") {
+		t.Fatalf("'%v' expected in %v", "instance-1", args)
+	}
+	// Neither is the User option, ssh would login as it
+	for _, args := range [][]string{gcloudSSHArgs(&cfg, ar), gcloudSCPArgs(&cfg, ar)} {
+		for _, arg := range args {
+			if strings.Contains(arg, "User=") {
+				t.Fatalf("'%v' not expected in %v", arg, args)
+			}
+		}
+	}
+	buf.Reset()
+	checkOSLoginUser(&cfg, ar)
+	if buf.Len() != 0 {
+		t.Fatalf("no warning expected, found '%v'", buf.String())
+	}
+
+	ar.Options = []string{"User=deploy"}
+	checkOSLoginUser(&cfg, ar)
+	if !strings.Contains(buf.String(), "WARNING: Connecting with OS Login as andy_retailnext_net of the gcloud account andy@retailnext.net instead of the user deploy") {
+		t.Fatalf("user mismatch warning expected, found '%v'", buf.String())
+	}
+
+	cfg.OSLogin = false
+	if args := gcloudSSHArgs(&cfg, ar); !hasArg(args, "deploy@instance-1") || !hasArg(args, "--ssh-flag=-o User=deploy") {
+		t.Fatalf("'%v' expected in %v", "deploy@instance-1", args)
+	}
+}
+
+func TestGCloudConfigAccount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcloud-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "configurations"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"active_config":               "work\n",
+		"configurations/config_work":  "[compute]\naccount = compute@retailnext.net\n\n[core]\nproject = project-1\naccount = andy@retailnext.net\n",
+		"configurations/config_other": "[core]\naccount=deploy@project-1.iam.gserviceaccount.com\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Unsetenv("CLOUDSDK_CONFIG")
+	os.Setenv("CLOUDSDK_CONFIG", dir)
+
+	// gcloud isn't run when its configuration has the account
+	cfg := defaultConfig()
+	cfg.GcloudPath, cfg.CacheDir = filepath.Join(dir, "gcloud"), filepath.Join(dir, "cache")
+	for gcloudConfig, expected := range map[string]string{
+		"":        "andy@retailnext.net",
+		"other":   "deploy@project-1.iam.gserviceaccount.com",
+		"missing": "",
+	} {
+		cfg.GcloudConfig = gcloudConfig
+		account, err := activeGCloudAccount(&cfg)
+		if account != expected || (expected != "") == (err != nil) {
+			t.Fatalf("%q: '%v' != '%v': %v", gcloudConfig, account, expected, err)
+		}
+	}
+
+	// The account gcloud gets is cached
+	cfg.GcloudConfig = "missing"
+	gcloud := "#!/bin/sh\necho $* >> " + filepath.Join(dir, "runs") + "\necho ci@retailnext.net\n"
+	if err := ioutil.WriteFile(cfg.GcloudPath, []byte(gcloud), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if account, err := activeGCloudAccount(&cfg); err != nil || account != "ci@retailnext.net" {
+			t.Fatalf("'%v' != '%v': %v", account, "ci@retailnext.net", err)
+		}
+	}
+	if runs, err := ioutil.ReadFile(filepath.Join(dir, "runs")); err != nil || string(runs) != "--configuration missing config get-value account\n" {
+		t.Fatalf("gcloud must run once, ran: %q %v", runs, err)
+	}
+
+	defer os.Unsetenv("CLOUDSDK_CORE_ACCOUNT")
+	os.Setenv("CLOUDSDK_CORE_ACCOUNT", "ops@retailnext.net")
+	if account := gcloudConfigAccount(&cfg); account != "ops@retailnext.net" {
+		t.Fatalf("'%v' != '%v'", account, "ops@retailnext.net")
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Runner runs a binary with the wrapper standard streams, stderr is also
+// copied to the stderr writer when not nil. The run is killed after timeout,
+// if not 0.
+type Runner func(name string, args []string, stderr io.Writer, timeout time.Duration) error
+
+// runner runs the gcloud, ssh and scp binaries, replaced in tests to check
+// their arguments without running them
+var runner Runner = execRunner
+
+// The ssh and scp runs read the wrapper input, ansible pipes the files it
+// copies with dd to the remote command
+func execRunner(name string, args []string, stderr io.Writer, timeout time.Duration) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if stderr != nil {
+		cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	}
+	return runCommand(cmd, timeout)
+}
+
+// stoppedError is the error of a run the wrapper stopped, on a signal it
+// forwarded or its timeout. Such runs must not be run again.
+type stoppedError struct {
+	message string
+	err     error
+}
+
+func (e *stoppedError) Error() string {
+	return e.message
+}
+
+func (e *stoppedError) Unwrap() error {
+	return e.err
+}
+
+// checks if the run was stopped by the wrapper
+func isStopped(err error) bool {
+	var stopped *stoppedError
+	return errors.As(err, &stopped)
+}
+
+// checks if the run failed because the instance couldn't be connected to: ssh
+// exits with 255 when it can't connect, other exit codes are the remote
+// command own failures. The runs killed by a signal, stopped by the wrapper or
+// that couldn't start never connected to it.
+func isConnectionFailure(err error) bool {
+	var exitErr *exec.ExitError
+	if isStopped(err) || !errors.As(err, &exitErr) {
+		return false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	return ok && !status.Signaled() && status.ExitStatus() == exitCodeFailure
+}
+
+// signalGracePeriod is the time the child processes have to exit once the
+// wrapper is interrupted before they are killed
+var signalGracePeriod = 5 * time.Second
+
+// Runs cmd in its own process group forwarding SIGINT and SIGTERM to the
+// whole group, so canceling an ansible job also stops the gcloud ssh and IAP
+// tunnel processes. The group is killed when it runs longer than timeout, if
+// not 0.
+func runCommand(cmd *exec.Cmd, timeout time.Duration) error {
+	// A child reading a terminal must stay in the foreground process group,
+	// where the terminal signals already reach it
+	group := !isTerminal(cmd.Stdin)
+	if group {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	pid := cmd.Process.Pid
+	if group {
+		pid = -pid
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	timedOut, interrupted := false, false
+	var killed <-chan time.Time
+	for {
+		select {
+		case err := <-done:
+			if timedOut {
+				return &stoppedError{message: fmt.Sprintf("%s command timed out after %v", filepath.Base(cmd.Path), timeout), err: err}
+			}
+			if interrupted && err != nil {
+				return &stoppedError{message: err.Error(), err: err}
+			}
+			return err
+		case <-expired:
+			logger.Warnf("Killing %s, still running after the %v timeout", cmd.Path, timeout)
+			syscall.Kill(pid, syscall.SIGKILL)
+			timedOut = true
+		case sig := <-signals:
+			logger.Warnf("Forwarding %v to %s", sig, cmd.Path)
+			syscall.Kill(pid, sig.(syscall.Signal))
+			interrupted = true
+			if killed == nil {
+				killed = time.After(signalGracePeriod)
+			}
+		case <-killed:
+			logger.Warnf("Killing %s, still running %v after the signal", cmd.Path, signalGracePeriod)
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+}
+
+// checks if the child input is a terminal
+func isTerminal(stdin interface{}) bool {
+	f, ok := stdin.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
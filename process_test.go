@@ -0,0 +1,53 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCommandForwardsSignals(t *testing.T) {
+	// The child interrupts the wrapper, the signal must reach its process group
+	cmd := exec.Command("sh", "-c", "kill -TERM $PPID; sleep 10 & wait")
+	start := time.Now()
+	err := runCommand(cmd, 0)
+	if err == nil {
+		t.Fatal("interrupted child error expected")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("child must exit on the signal, ran for %v", elapsed)
+	}
+
+	if err := runCommand(exec.Command("true"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if code := exitCode(runCommand(exec.Command("sh", "-c", "exit 3"), 0)); code != 3 {
+		t.Fatalf("'%v' != '%v'", code, 3)
+	}
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	// The orphaned sleep would keep the output open if only sh was killed
+	var out bytes.Buffer
+	cmd := exec.Command("sh", "-c", "sleep 10 & wait")
+	cmd.Stdout = &out
+	start := time.Now()
+	err := runCommand(cmd, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "sh command timed out after 100ms") {
+		t.Fatalf("timed out error expected, found '%v'", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("the process group must be killed, ran for %v", elapsed)
+	}
+
+	if err := runCommand(exec.Command("true"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// redactedValue replaces the sensitive option values in the logs
+const redactedValue = "***"
+
+var (
+	// redactKeys are the ssh option keys whose values are never logged,
+	// extended with GCLOUD_SSH_REDACT_KEYS
+	redactKeys = []string{"User"}
+
+	// secretKeyRegexp matches the option keys that look like holding secrets
+	secretKeyRegexp = regexp.MustCompile(`(?i)pass|token|secret`)
+)
+
+// checks if the value of an option key must not be logged
+func isRedactedKey(key string) bool {
+	if secretKeyRegexp.MatchString(key) {
+		return true
+	}
+	for _, redactKey := range redactKeys {
+		if strings.EqualFold(key, redactKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces the value of a Key=value option if sensitive
+func redactOption(option string) string {
+	if i := strings.Index(option, "="); i > 0 && isRedactedKey(option[:i]) {
+		return option[:i+1] + redactedValue
+	}
+	return option
+}
+
+// Redacts the options of ssh or scp command line arguments, given either as
+// "-o Key=value" or "-oKey=value", and the user of the loginFlag like -l of
+// ssh. Only ssh has one, -l is the bandwidth limit of scp.
+func redactArgs(args []string, loginFlag string) []string {
+	login := loginFlag != "" && isRedactedKey("User")
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		switch {
+		case i > 0 && args[i-1] == "-o":
+			redacted[i] = redactOption(arg)
+		case strings.HasPrefix(arg, "-o") && len(arg) > 2:
+			redacted[i] = "-o" + redactOption(arg[2:])
+		case login && i > 0 && args[i-1] == loginFlag:
+			redacted[i] = redactedValue
+		case login && strings.HasPrefix(arg, loginFlag) && len(arg) > len(loginFlag):
+			redacted[i] = loginFlag + redactedValue
+		default:
+			redacted[i] = arg
+		}
+	}
+	return redacted
+}
+
+// Returns a copy of the run to log with its sensitive options redacted
+func (ar AnsibleRun) redacted() AnsibleRun {
+	options := make([]string, len(ar.Options))
+	for i, option := range ar.Options {
+		options[i] = redactOption(option)
+	}
+	ar.Options = options
+	return ar
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	a, err := ParseAnsibleArgs([]string{"ssh", "-o", `User="andy_retailnext_net"`, "-o", "ConnectTimeout=10", "-o", "IdentityAgentToken=abc", "172.16.0.11", "ls"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := fmt.Sprintf("%#+v", a.redacted())
+	if strings.Contains(logged, "andy_retailnext_net") || strings.Contains(logged, "abc") {
+		t.Fatalf("sensitive values logged: %v", logged)
+	}
+	if !strings.Contains(logged, "User=***") || !strings.Contains(logged, "ConnectTimeout=10") {
+		t.Fatalf("unexpected redaction: %v", logged)
+	}
+	// The run itself keeps the values
+	if a.User() != "andy_retailnext_net" {
+		t.Fatalf("'%v' != '%v'", a.User(), "andy_retailnext_net")
+	}
+
+	defer func(original []string) { redactKeys = original }(redactKeys)
+	redactKeys = append(redactKeys, "ProxyCommand")
+	args := redactArgs([]string{"-C", "-o", "User=foo", "-oProxyCommand=nc %h %p", "-o", "ConnectTimeout=10", "172.16.0.11"}, "-l")
+	expected := []string{"-C", "-o", "User=***", "-oProxyCommand=***", "-o", "ConnectTimeout=10", "172.16.0.11"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("'%v' != '%v'", args, expected)
+	}
+
+	// The ssh login user is the User option too, the scp -l is a limit
+	args = redactArgs([]string{"-l", "foo", "-lbar", "172.16.0.11"}, "-l")
+	expected = []string{"-l", "***", "-l***", "172.16.0.11"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("'%v' != '%v'", args, expected)
+	}
+	args = redactArgs([]string{"-l", "8192", "/tmp/file", "172.16.0.11:/tmp/"}, "")
+	expected = []string{"-l", "8192", "/tmp/file", "172.16.0.11:/tmp/"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("'%v' != '%v'", args, expected)
+	}
+}
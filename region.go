@@ -0,0 +1,87 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+var (
+	// regionZones are the zones of the regions already got, the resolver
+	// daemon gets them once
+	regionZonesMu sync.Mutex
+	regionZones   = map[string][]string{}
+)
+
+// Gets cfg.Zones followed by the zones of cfg.Regions, got from project
+func searchedZones(ctx context.Context, computeService *compute.Service, cfg *Config, project string) ([]string, error) {
+	zones := append([]string{}, cfg.Zones...)
+	seen := map[string]bool{}
+	for _, zone := range zones {
+		seen[zone] = true
+	}
+	for _, region := range cfg.Regions {
+		members, err := getRegionZones(ctx, computeService, cfg, project, region)
+		if err != nil {
+			return nil, err
+		}
+		for _, zone := range members {
+			if !seen[zone] {
+				seen[zone] = true
+				zones = append(zones, zone)
+			}
+		}
+	}
+	return zones, nil
+}
+
+// Gets the zones of a region, from memory when already got or from the cache
+// when got by another process less than cfg.CacheTTL ago
+func getRegionZones(ctx context.Context, computeService *compute.Service, cfg *Config, project, region string) ([]string, error) {
+	regionZonesMu.Lock()
+	zones, ok := regionZones[region]
+	regionZonesMu.Unlock()
+	if ok {
+		return zones, nil
+	}
+	cache := newResolutionCache(cfg.CacheDir, cfg.CacheTTL, cfg)
+	if zones, ok := cache.GetRegionZones(region); ok {
+		regionZonesMu.Lock()
+		regionZones[region] = zones
+		regionZonesMu.Unlock()
+		return zones, nil
+	}
+
+	computeService, err := projectComputeService(cfg, computeService, project)
+	if err != nil {
+		return nil, err
+	}
+	regionCall := computeService.Regions.Get(project, region)
+	regionCall.Context(ctx)
+	var result *compute.Region
+	err = withRetry(ctx, cfg.MaxRetries, func() (err error) {
+		result, err = regionCall.Do()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get the zones of region %s: %w", region, err)
+	}
+	// The zones are self-links ending with the zone name
+	for _, zone := range result.Zones {
+		zones = append(zones, path.Base(zone))
+	}
+
+	cache.PutRegionZones(region, zones)
+	regionZonesMu.Lock()
+	regionZones[region] = zones
+	regionZonesMu.Unlock()
+	return zones, nil
+}
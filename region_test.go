@@ -0,0 +1,131 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFindInstanceRegions(t *testing.T) {
+	defer func() { regionZones = map[string][]string{} }()
+	var mu sync.Mutex
+	regionGets := 0
+	var searched []string
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.HasSuffix(req.URL.Path, "/regions/us-central1") {
+			regionGets++
+			return jsonResponse(http.StatusOK, `{"name": "us-central1", "zones": [
+				"https://www.googleapis.com/compute/v1/projects/project-1/zones/us-central1-a",
+				"https://www.googleapis.com/compute/v1/projects/project-1/zones/us-central1-b"
+			]}`), nil
+		}
+		zone := req.URL.Path[strings.Index(req.URL.Path, "/zones/")+len("/zones/"):]
+		zone = strings.TrimSuffix(zone, "/instances")
+		searched = append(searched, zone)
+		if zone != "us-central1-b" {
+			return jsonResponse(http.StatusOK, `{}`), nil
+		}
+		return jsonResponse(http.StatusOK, `{"items": [{"name": "instance-1", "networkInterfaces": [{"networkIP": "172.16.0.11"}]}]}`), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1"}, Zones: []string{"europe-west1-b", "us-central1-a"}, Regions: []string{"us-central1"}, MaxRetries: 4, Concurrency: 1}
+	instanceName, zone, _, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instanceName != "instance-1" || zone != "us-central1-b" {
+		t.Fatalf("unexpected instance: %v %v", instanceName, zone)
+	}
+	sort.Strings(searched)
+	if expected := []string{"europe-west1-b", "us-central1-a", "us-central1-b"}; !reflect.DeepEqual(searched, expected) {
+		t.Fatalf("'%v' != '%v'", searched, expected)
+	}
+
+	// The region zones are got once
+	if _, _, _, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11"); err != nil {
+		t.Fatal(err)
+	}
+	if regionGets != 1 {
+		t.Fatalf("'%v' != '%v'", regionGets, 1)
+	}
+}
+
+func TestRegionZonesCache(t *testing.T) {
+	defer func() { regionZones = map[string][]string{} }()
+	dir, err := ioutil.TempDir("", "gcloud-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	regionGets := 0
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		regionGets++
+		return jsonResponse(http.StatusOK, `{"name": "us-central1", "zones": ["zones/us-central1-a", "zones/us-central1-b"]}`), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1"}, CacheDir: dir, CacheTTL: time.Minute, MaxRetries: 4}
+	expected := []string{"us-central1-a", "us-central1-b"}
+	for i := 0; i < 2; i++ {
+		// Every ansible task runs in a new process
+		regionZones = map[string][]string{}
+		zones, err := getRegionZones(context.Background(), computeService, cfg, "project-1", "us-central1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(zones, expected) {
+			t.Fatalf("'%v' != '%v'", zones, expected)
+		}
+	}
+	if regionGets != 1 {
+		t.Fatalf("'%v' != '%v'", regionGets, 1)
+	}
+}
+
+func TestSearchScopesRegionFallback(t *testing.T) {
+	defer func() { regionZones = map[string][]string{} }()
+	var regionGets []string
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		regionGets = append(regionGets, req.URL.Path)
+		if strings.Contains(req.URL.Path, "/projects/project-1/") {
+			return jsonResponse(http.StatusForbidden, `{"error": {"code": 403, "message": "Forbidden"}}`), nil
+		}
+		return jsonResponse(http.StatusOK, `{"name": "us-central1", "zones": [
+			"https://www.googleapis.com/compute/v1/projects/project-2/zones/us-central1-a"
+		]}`), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1", "project-2"}, Regions: []string{"us-central1"}, MaxRetries: 4}
+	scopes, err := searchScopes(context.Background(), computeService, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []searchScope{{project: "project-1", zone: "us-central1-a"}, {project: "project-2", zone: "us-central1-a"}}
+	if !reflect.DeepEqual(scopes, expected) {
+		t.Fatalf("'%v' != '%v'", scopes, expected)
+	}
+	expectedGets := []string{"/compute/v1/projects/project-1/regions/us-central1", "/compute/v1/projects/project-2/regions/us-central1"}
+	if !reflect.DeepEqual(regionGets, expectedGets) {
+		t.Fatalf("'%v' != '%v'", regionGets, expectedGets)
+	}
+
+	// Without any project allowing it the search fails
+	regionZones = map[string][]string{}
+	cfg.Projects = []string{"project-1"}
+	if _, err := searchScopes(context.Background(), computeService, cfg); err == nil || !isPermissionDenied(err) {
+		t.Fatalf("permission error expected, found: %v", err)
+	}
+}
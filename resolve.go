@@ -0,0 +1,135 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// checks if the wrapper is asked to resolve a host instead of running ssh or
+// scp, ansible never passes a resolve first argument
+func isResolveRequest(args []string) bool {
+	return len(args) > 1 && args[1] == "resolve"
+}
+
+// resolution is the instance a host resolves to, printed as JSON
+type resolution struct {
+	Instance  string `json:"instance,omitempty"`
+	Zone      string `json:"zone,omitempty"`
+	Project   string `json:"project,omitempty"`
+	NetworkIP string `json:"networkIP,omitempty"`
+	// Error is why a host of a batch is not resolved
+	Error string `json:"error,omitempty"`
+}
+
+// Resolves a network IP or instance name like the ssh and scp runs without
+// running gcloud, printing the instance found as JSON to out and the errors
+// to errOut, returning the exit code
+func resolveHost(ctx context.Context, cfg *Config, cache *resolutionCache, args []string, out, errOut io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(errOut, "Usage: gcloud-ssh resolve <IP or instance name>...")
+		return 2
+	}
+	// Resolving changes nothing, like the batch search never starting the
+	// instances found. The daemon resolves with its own config, which may
+	// start them, so it is not asked.
+	readOnly := *cfg
+	readOnly.readOnly, readOnly.Socket = true, ""
+	cfg = &readOnly
+	if len(args) > 1 {
+		return resolveHosts(ctx, cfg, cache, args, out, errOut)
+	}
+	ansible := AnsibleRun{Destination: args[0]}
+	if err := updateWithInstanceName(ctx, cfg, cache, &ansible); err != nil {
+		logger.Errorf("%v", err)
+		fmt.Fprintln(errOut, err)
+		return 1
+	}
+
+	result := newResolution(ansible.Host, cacheEntry{Instance: ansible.Destination, Zone: ansible.Zone, Project: ansible.Project})
+	if err := json.NewEncoder(out).Encode(result); err != nil {
+		fmt.Fprintln(errOut, err)
+		return 1
+	}
+	return 0
+}
+
+// Resolves several hosts at once, printing a JSON object of their resolutions
+// keyed by host to out. The network IPs and instance names not cached are
+// searched in a single pass, the other hosts one by one.
+func resolveHosts(ctx context.Context, cfg *Config, cache *resolutionCache, hosts []string, out, errOut io.Writer) int {
+	// With GCLOUD_SSH_ZONE and GCLOUD_SSH_PROJECT the instance names are
+	// resolved without searching, and the IPs only searched in that zone
+	override := cfg.Zone != "" && cfg.Project != ""
+	searchCfg := cfg
+	if override {
+		searchCfg, cache = zoneConfig(cfg), nil
+	}
+	results := map[string]resolution{}
+	var batch []string
+	for _, host := range hosts {
+		if _, ok := results[host]; ok {
+			continue
+		}
+		if entry, ok := cache.Get(host); ok && isProjectAllowed(cfg, entry.Project) {
+			results[host] = newResolution(host, entry)
+			continue
+		}
+		if parseIP(host) == nil && (override || !isInstanceName(host)) {
+			ansible := AnsibleRun{Destination: host}
+			if err := updateWithInstanceName(ctx, cfg, cache, &ansible); err != nil {
+				results[host] = resolution{Error: err.Error()}
+				continue
+			}
+			results[host] = newResolution(host, cacheEntry{Instance: ansible.Destination, Zone: ansible.Zone, Project: ansible.Project})
+			continue
+		}
+		results[host] = resolution{}
+		batch = append(batch, host)
+	}
+
+	if len(batch) > 0 {
+		computeService, err := getComputeService(cfg)
+		if err != nil {
+			fmt.Fprintln(errOut, err)
+			return 1
+		}
+		found, failed := searchInstances(ctx, computeService, searchCfg, batch)
+		for host, match := range found {
+			entry := cacheEntry{Instance: match.instance, Zone: match.zone, Project: match.project, Interface: match.networkInterface, Preemptible: match.preemptible, ID: match.id}
+			cache.Put(host, entry)
+			results[host] = newResolution(host, entry)
+		}
+		for host, err := range failed {
+			results[host] = resolution{Error: err.Error()}
+		}
+	}
+
+	code := 0
+	for host, result := range results {
+		if result.Error != "" {
+			logger.Errorf("Cannot resolve %s: %s", host, result.Error)
+			code = 1
+		}
+	}
+	if err := json.NewEncoder(out).Encode(results); err != nil {
+		fmt.Fprintln(errOut, err)
+		return 1
+	}
+	return code
+}
+
+// Builds the resolution of host to the instance of entry
+func newResolution(host string, entry cacheEntry) resolution {
+	result := resolution{Instance: entry.Instance, Zone: entry.Zone, Project: entry.Project}
+	if parseIP(host) != nil {
+		result.NetworkIP = host
+	}
+	return result
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveHost(t *testing.T) {
+	var searched []string
+	stubComputeService(t, func(req *http.Request) (*http.Response, error) {
+		searched = append(searched, req.URL.Path)
+		return jsonResponse(http.StatusOK, aggregatedListResponse), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1"}, MaxRetries: 4, Concurrency: 1}
+	var out, errOut bytes.Buffer
+	if code := resolveHost(context.Background(), cfg, nil, []string{"172.16.0.11"}, &out, &errOut); code != 0 {
+		t.Fatalf("'%v' != '%v': %s", code, 0, errOut.String())
+	}
+	expected := `{"instance":"instance-1","zone":"us-central1-a","project":"project-1","networkIP":"172.16.0.11"}` + "\n"
+	if out.String() != expected {
+		t.Fatalf("'%v' != '%v'", out.String(), expected)
+	}
+	if len(searched) != 1 || !strings.Contains(searched[0], "/projects/project-1/") {
+		t.Fatalf("unexpected searches: %v", searched)
+	}
+
+	out.Reset()
+	if code := resolveHost(context.Background(), cfg, nil, []string{"172.16.0.12"}, &out, &errOut); code != 1 {
+		t.Fatalf("'%v' != '%v'", code, 1)
+	}
+	if out.Len() != 0 || !strings.Contains(errOut.String(), "Not found") {
+		t.Fatalf("not found error expected, found '%v' '%v'", out.String(), errOut.String())
+	}
+}
+
+func TestResolveHostReadOnly(t *testing.T) {
+	var methods []string
+	stubComputeService(t, func(req *http.Request) (*http.Response, error) {
+		methods = append(methods, req.Method)
+		return jsonResponse(http.StatusOK, `{"items": {"zones/us-central1-a": {"instances": [
+			{"name": "instance-1", "status": "TERMINATED", "networkInterfaces": [{"networkIP": "172.16.0.11"}]}
+		]}}}`), nil
+	})
+
+	dir, err := ioutil.TempDir("", "gcloud-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "gcloud-ssh.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	daemon := &resolverDaemon{
+		ttl: time.Minute,
+		lookup: func(host string) (cacheEntry, error) {
+			t.Errorf("the daemon may start %s", host)
+			return cacheEntry{}, nil
+		},
+		entries: map[string]cacheEntry{},
+	}
+	go daemon.serve(listener)
+
+	// The stopped instance is found but not started, by the daemon neither
+	cfg := &Config{Projects: []string{"project-1"}, AutoStart: true, BootWait: time.Minute, MaxRetries: 4, Concurrency: 1, Socket: socket, Timeout: time.Second}
+	var out, errOut bytes.Buffer
+	if code := resolveHost(context.Background(), cfg, nil, []string{"172.16.0.11"}, &out, &errOut); code != 0 {
+		t.Fatalf("'%v' != '%v': %s", code, 0, errOut.String())
+	}
+	if !strings.Contains(out.String(), `"instance":"instance-1"`) {
+		t.Fatalf("unexpected resolution: %v", out.String())
+	}
+	if !reflect.DeepEqual(methods, []string{http.MethodGet}) {
+		t.Fatalf("unexpected compute API calls: %v", methods)
+	}
+}
+
+func TestResolveHosts(t *testing.T) {
+	var searched []string
+	stubComputeService(t, func(req *http.Request) (*http.Response, error) {
+		searched = append(searched, req.URL.Path)
+		return jsonResponse(http.StatusOK, `{"items": {
+			"zones/us-central1-a": {"instances": [
+				{"name": "instance-1", "networkInterfaces": [{"networkIP": "172.16.0.11"}]},
+				{"name": "instance-2", "networkInterfaces": [{"networkIP": "172.16.0.12"}]}
+			]},
+			"zones/us-central1-b": {"instances": [
+				{"name": "instance-3", "networkInterfaces": [{"networkIP": "172.16.0.13"}]}
+			]}
+		}}`), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1"}, MaxRetries: 4, Concurrency: 1}
+	var out, errOut bytes.Buffer
+	if code := resolveHost(context.Background(), cfg, nil, []string{"172.16.0.11", "172.16.0.12", "instance-3"}, &out, &errOut); code != 0 {
+		t.Fatalf("'%v' != '%v': %s", code, 0, errOut.String())
+	}
+	expected := `{"172.16.0.11":{"instance":"instance-1","zone":"us-central1-a","project":"project-1","networkIP":"172.16.0.11"},` +
+		`"172.16.0.12":{"instance":"instance-2","zone":"us-central1-a","project":"project-1","networkIP":"172.16.0.12"},` +
+		`"instance-3":{"instance":"instance-3","zone":"us-central1-b","project":"project-1"}}` + "\n"
+	if out.String() != expected {
+		t.Fatalf("'%v' != '%v'", out.String(), expected)
+	}
+	// The three hosts are found listing the project once
+	if len(searched) != 1 {
+		t.Fatalf("unexpected searches: %v", searched)
+	}
+
+	out.Reset()
+	if code := resolveHost(context.Background(), cfg, nil, []string{"172.16.0.11", "172.16.0.99"}, &out, &errOut); code != 1 {
+		t.Fatalf("'%v' != '%v'", code, 1)
+	}
+	if !strings.Contains(out.String(), `"172.16.0.99":{"error":"Not found networkIP: 172.16.0.99"}`) || !strings.Contains(out.String(), `"instance":"instance-1"`) {
+		t.Fatalf("unexpected resolutions: %v", out.String())
+	}
+}
+
+func TestResolveHostsZoneOverride(t *testing.T) {
+	var searched []string
+	stubComputeService(t, func(req *http.Request) (*http.Response, error) {
+		searched = append(searched, req.URL.Path)
+		return jsonResponse(http.StatusOK, `{"items": [{"name": "instance-1", "networkInterfaces": [{"networkIP": "172.16.0.11"}]}]}`), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1"}, Zone: "us-central1-b", Project: "project-2", MaxRetries: 4, Concurrency: 1}
+	var out, errOut bytes.Buffer
+	if code := resolveHost(context.Background(), cfg, nil, []string{"172.16.0.11", "instance-3"}, &out, &errOut); code != 0 {
+		t.Fatalf("'%v' != '%v': %s", code, 0, errOut.String())
+	}
+	expected := `{"172.16.0.11":{"instance":"instance-1","zone":"us-central1-b","project":"project-2","networkIP":"172.16.0.11"},` +
+		`"instance-3":{"instance":"instance-3","zone":"us-central1-b","project":"project-2"}}` + "\n"
+	if out.String() != expected {
+		t.Fatalf("'%v' != '%v'", out.String(), expected)
+	}
+	// Only the IP is searched, in the zone
+	if !reflect.DeepEqual(searched, []string{"/compute/v1/projects/project-2/zones/us-central1-b/instances"}) {
+		t.Fatalf("unexpected searches: %v", searched)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+var (
+	// startPollInterval is the delay before the second check of a starting
+	// or booting instance, doubled on every following check up to
+	// maxPollInterval
+	startPollInterval = 2 * time.Second
+	maxPollInterval   = 15 * time.Second
+)
+
+// Starts the instance if it is stopped and waits for it to run, up to
+// cfg.AutoStartTimeout as booting takes longer than the compute API lookup
+func startInstance(computeService *compute.Service, cfg *Config, project, zone, instanceName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.AutoStartTimeout)
+	defer cancel()
+	log := logger.With("project", project, "zone", zone, "instance", instanceName)
+
+	instance, err := getInstance(ctx, computeService, cfg, project, zone, instanceName)
+	if err != nil {
+		return err
+	}
+	if isBooting(instance.Status) {
+		return waitRunning(ctx, computeService, cfg, project, zone, instanceName, cfg.AutoStartTimeout)
+	}
+	if instance.Status != "TERMINATED" {
+		return nil
+	}
+
+	log.Infof("Starting stopped instance: %s", instanceName)
+	startCall := computeService.Instances.Start(project, zone, instanceName)
+	startCall.Context(ctx)
+	var operation *compute.Operation
+	err = withRetry(ctx, cfg.MaxRetries, func() (err error) {
+		operation, err = startCall.Do()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Cannot start instance %s: %w", instanceName, err)
+	}
+
+	// Wait returns when the operation is done or after a while
+	for operation.Status != "DONE" {
+		waitCall := computeService.ZoneOperations.Wait(project, zone, operation.Name)
+		waitCall.Context(ctx)
+		err = withRetry(ctx, cfg.MaxRetries, func() (err error) {
+			operation, err = waitCall.Do()
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Cannot start instance %s: %w", instanceName, err)
+		}
+	}
+	if operation.Error != nil && len(operation.Error.Errors) > 0 {
+		return fmt.Errorf("Cannot start instance %s: %s", instanceName, operation.Error.Errors[0].Message)
+	}
+
+	if err := waitRunning(ctx, computeService, cfg, project, zone, instanceName, cfg.AutoStartTimeout); err != nil {
+		return err
+	}
+	log.Infof("Started instance: %s", instanceName)
+	return nil
+}
+
+// Waits for an instance found while it was still booting to run, up to
+// cfg.BootWait
+func waitForBoot(computeService *compute.Service, cfg *Config, project, zone, instanceName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.BootWait)
+	defer cancel()
+
+	instance, err := getInstance(ctx, computeService, cfg, project, zone, instanceName)
+	if err != nil {
+		return err
+	}
+	if !isBooting(instance.Status) {
+		return nil
+	}
+	logger.With("project", project, "zone", zone, "instance", instanceName).Infof("Waiting for %s instance: %s to run", instance.Status, instanceName)
+	return waitRunning(ctx, computeService, cfg, project, zone, instanceName, cfg.BootWait)
+}
+
+// checks if an instance status is one before RUNNING
+func isBooting(status string) bool {
+	return status == "PROVISIONING" || status == "STAGING"
+}
+
+// Polls the instance until it is RUNNING or ctx is done, timeout only tells
+// the deadline of ctx in the error
+func waitRunning(ctx context.Context, computeService *compute.Service, cfg *Config, project, zone, instanceName string, timeout time.Duration) error {
+	status := ""
+	err := poll(ctx, func() (bool, error) {
+		instance, err := getInstance(ctx, computeService, cfg, project, zone, instanceName)
+		if err != nil {
+			return false, err
+		}
+		status = instance.Status
+		return status == "RUNNING", nil
+	})
+	if errors.Is(err, context.DeadlineExceeded) && status != "" {
+		return fmt.Errorf("Instance %s not running after %v, status: %s", instanceName, timeout, status)
+	}
+	return err
+}
+
+// Calls check until it is done, fails or ctx is done, with exponential
+// backoff and jitter between the calls
+func poll(ctx context.Context, check func() (bool, error)) error {
+	delay := startPollInterval
+	for {
+		done, err := check()
+		if done || err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(jitter(delay)):
+		}
+		if delay *= 2; delay > maxPollInterval {
+			delay = maxPollInterval
+		}
+	}
+}
+
+func getInstance(ctx context.Context, computeService *compute.Service, cfg *Config, project, zone, instanceName string) (*compute.Instance, error) {
+	getCall := computeService.Instances.Get(project, zone, instanceName)
+	getCall.Context(ctx)
+	var instance *compute.Instance
+	err := withRetry(ctx, cfg.MaxRetries, func() (err error) {
+		instance, err = getCall.Do()
+		return err
+	})
+	return instance, err
+}
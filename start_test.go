@@ -0,0 +1,142 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartInstance(t *testing.T) {
+	startPollInterval = time.Millisecond
+	statuses := []string{"TERMINATED", "STAGING", "RUNNING"}
+	var calls []string
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		switch {
+		case req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/instances/instance-1/start"):
+			calls = append(calls, "start")
+			return jsonResponse(http.StatusOK, `{"name": "operation-1", "status": "RUNNING"}`), nil
+		case req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/operations/operation-1/wait"):
+			calls = append(calls, "wait")
+			return jsonResponse(http.StatusOK, `{"name": "operation-1", "status": "DONE"}`), nil
+		case req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/instances/instance-1"):
+			calls = append(calls, "get")
+			status := statuses[0]
+			if len(statuses) > 1 {
+				statuses = statuses[1:]
+			}
+			return jsonResponse(http.StatusOK, `{"name": "instance-1", "status": "`+status+`"}`), nil
+		}
+		t.Fatalf("unexpected request: %v %v", req.Method, req.URL.Path)
+		return nil, nil
+	})
+
+	cfg := &Config{AutoStartTimeout: 5 * time.Second}
+	if err := startInstance(computeService, cfg, "project-1", "us-central1-a", "instance-1"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(calls, []string{"get", "start", "wait", "get", "get"}) {
+		t.Fatalf("unexpected calls: %v", calls)
+	}
+
+	// A running instance is left alone
+	calls = nil
+	if err := startInstance(computeService, cfg, "project-1", "us-central1-a", "instance-1"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(calls, []string{"get"}) {
+		t.Fatalf("unexpected calls: %v", calls)
+	}
+}
+
+func TestSearchedStatusesAutoStart(t *testing.T) {
+	cfg := &Config{StatusFilter: []string{"RUNNING"}, AutoStart: true}
+	if filter := statusFilter(searchedStatuses(cfg)); filter != "((status = RUNNING) OR (status = TERMINATED))" {
+		t.Fatalf("unexpected filter: %v", filter)
+	}
+	if !reflect.DeepEqual(cfg.StatusFilter, []string{"RUNNING"}) {
+		t.Fatalf("unexpected status filter: %v", cfg.StatusFilter)
+	}
+}
+
+func TestWaitForBoot(t *testing.T) {
+	startPollInterval = time.Millisecond
+	statuses := []string{"STAGING", "STAGING", "RUNNING"}
+	gets := 0
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		if req.Method != http.MethodGet || !strings.HasSuffix(req.URL.Path, "/instances/instance-1") {
+			t.Fatalf("unexpected request: %v %v", req.Method, req.URL.Path)
+		}
+		gets++
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+		return jsonResponse(http.StatusOK, `{"name": "instance-1", "status": "`+status+`"}`), nil
+	})
+
+	// Booting instances are searched by default
+	cfg := defaultConfig()
+	if filter := statusFilter(searchedStatuses(&cfg)); filter != "((status = RUNNING) OR (status = PROVISIONING) OR (status = STAGING))" {
+		t.Fatalf("unexpected filter: %v", filter)
+	}
+
+	cfg.BootWait = 5 * time.Second
+	if err := waitForBoot(computeService, &cfg, "project-1", "us-central1-a", "instance-1"); err != nil {
+		t.Fatal(err)
+	}
+	if gets != 3 {
+		t.Fatalf("'%v' != '%v'", gets, 3)
+	}
+
+	statuses = []string{"STAGING"}
+	cfg.BootWait = 10 * time.Millisecond
+	if err := waitForBoot(computeService, &cfg, "project-1", "us-central1-a", "instance-1"); err == nil || !strings.Contains(err.Error(), "not running") {
+		t.Fatalf("not running error expected, found '%v'", err)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	defer func(start, max time.Duration) {
+		startPollInterval, maxPollInterval = start, max
+	}(startPollInterval, maxPollInterval)
+	startPollInterval, maxPollInterval = 10*time.Millisecond, 40*time.Millisecond
+
+	statuses := []string{"STAGING", "STAGING", "RUNNING", "RUNNING"}
+	checks := 0
+	start := time.Now()
+	err := poll(context.Background(), func() (bool, error) {
+		checks++
+		return statuses[checks-1] == "RUNNING", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two sleeps of at most 10ms and 20ms
+	if elapsed := time.Since(start); checks != 3 || elapsed > time.Second {
+		t.Fatalf("must stop on RUNNING, checked %v times in %v", checks, elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	checks = 0
+	err = poll(ctx, func() (bool, error) {
+		checks++
+		return false, nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("'%v' != '%v'", err, context.DeadlineExceeded)
+	}
+	// The delays are capped instead of doubling past the deadline
+	if checks < 3 {
+		t.Fatalf("'%v' < '%v'", checks, 3)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// statsdWriteTimeout bounds sending a metric so statsd never slows down the
+// ssh or scp run
+const statsdWriteTimeout = 100 * time.Millisecond
+
+// statsdClient sends metrics with DogStatsD tags over UDP. Metrics are best
+// effort, they are dropped on any error and a nil client sends nothing.
+type statsdClient struct {
+	conn net.Conn
+}
+
+// stats is the wrapper metrics client, nil until configured with an address
+var stats *statsdClient
+
+// Creates a client sending to the host:port addr, nil when addr is empty or
+// the client can't be created
+func newStatsdClient(addr string) *statsdClient {
+	if addr == "" {
+		return nil
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		logger.Warnf("Not sending metrics, cannot connect to statsd %s: %v", addr, err)
+		return nil
+	}
+	return &statsdClient{conn: conn}
+}
+
+// Sends a timer in milliseconds
+func (s *statsdClient) Timing(name string, d time.Duration, tags ...string) {
+	s.send(fmt.Sprintf("%s:%d|ms", name, d.Milliseconds()), tags)
+}
+
+// Increments a counter
+func (s *statsdClient) Incr(name string, tags ...string) {
+	s.send(name+":1|c", tags)
+}
+
+func (s *statsdClient) send(metric string, tags []string) {
+	if s == nil {
+		return
+	}
+	if len(tags) > 0 {
+		metric += "|#" + strings.Join(tags, ",")
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(statsdWriteTimeout))
+	if _, err := s.conn.Write([]byte(metric)); err != nil {
+		logger.Debugf("Cannot send metric %s: %v", metric, err)
+	}
+}
+
+func (s *statsdClient) Close() {
+	if s == nil {
+		return
+	}
+	s.conn.Close()
+}
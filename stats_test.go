@@ -0,0 +1,52 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsdClient(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client := newStatsdClient(server.LocalAddr().String())
+	if client == nil {
+		t.Fatal("statsd client expected")
+	}
+	defer client.Close()
+
+	client.Timing("gcloud_ssh.resolve.duration", 1500*time.Millisecond)
+	client.Incr("gcloud_ssh.gcloud.failure", "command:ssh", "exit_code:255")
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 512)
+	for _, expected := range []string{
+		"gcloud_ssh.resolve.duration:1500|ms",
+		"gcloud_ssh.gcloud.failure:1|c|#command:ssh,exit_code:255",
+	} {
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != expected {
+			t.Fatalf("'%v' != '%v'", string(buf[:n]), expected)
+		}
+	}
+
+	// A disabled client is a no-op
+	var disabled *statsdClient
+	disabled.Incr("gcloud_ssh.resolve.hit")
+	disabled.Close()
+	if newStatsdClient("") != nil {
+		t.Fatal("statsd client must be disabled without address")
+	}
+}
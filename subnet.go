@@ -0,0 +1,132 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// Drops the zone scopes outside the regions of the subnetworks containing
+// networkIP, instances can only have it in those regions. The scopes of all
+// the zones are kept, and so are all the scopes when no subnetwork contains
+// networkIP, like an external IP. The subnetworks aren't listed when every
+// scope is of all the zones, nothing could be dropped. The zones of the
+// projects whose subnetworks can't be listed are all kept, like the
+// forbidden ones that are skipped by the search.
+func prefilterScopes(ctx context.Context, computeService *compute.Service, cfg *Config, scopes []searchScope, networkIP net.IP) []searchScope {
+	zoned := false
+	for _, scope := range scopes {
+		zoned = zoned || scope.zone != ""
+	}
+	if !zoned {
+		return scopes
+	}
+
+	projects := []string{}
+	seen := map[string]bool{}
+	if cfg.HostProject != "" {
+		// Shared VPC subnetworks are in the host project
+		projects = append(projects, cfg.HostProject)
+		seen[cfg.HostProject] = true
+	}
+	for _, scope := range scopes {
+		if !seen[scope.project] {
+			seen[scope.project] = true
+			projects = append(projects, scope.project)
+		}
+	}
+
+	regions := map[string]string{}
+	unfiltered := map[string]bool{}
+	for _, project := range projects {
+		found, err := subnetworkRegions(ctx, computeService, cfg, project, networkIP)
+		if err != nil && project == cfg.HostProject {
+			logger.Debugf("Searching all the zones: %v", err)
+			return scopes
+		}
+		if err != nil {
+			logger.Debugf("Searching all the zones of project: %s: %v", project, err)
+			unfiltered[project] = true
+			continue
+		}
+		for _, region := range found {
+			regions[region] = project
+		}
+	}
+	if len(regions) == 0 {
+		logger.Debugf("No subnetwork contains %s, searching all the zones", networkIP)
+		return scopes
+	}
+
+	zones := map[string]bool{}
+	for region, project := range regions {
+		members, err := getRegionZones(ctx, computeService, cfg, project, region)
+		if err != nil {
+			logger.Debugf("Searching all the zones: %v", err)
+			return scopes
+		}
+		for _, zone := range members {
+			zones[zone] = true
+		}
+	}
+	prefiltered := []searchScope{}
+	for _, scope := range scopes {
+		if scope.zone == "" || unfiltered[scope.project] || zones[scope.zone] {
+			prefiltered = append(prefiltered, scope)
+		} else {
+			logger.Debugf("Not searching zone: %s of project: %s, no subnetwork of its region contains %s", scope.zone, scope.project, networkIP)
+		}
+	}
+	return prefiltered
+}
+
+// Gets the regions of the subnetworks of project containing networkIP in
+// their primary or secondary ranges
+func subnetworkRegions(ctx context.Context, computeService *compute.Service, cfg *Config, project string, networkIP net.IP) ([]string, error) {
+	computeService, err := projectComputeService(cfg, computeService, project)
+	if err != nil {
+		return nil, err
+	}
+	aggregatedListCall := computeService.Subnetworks.AggregatedList(project)
+	var regions []string
+	err = withRetry(ctx, cfg.MaxRetries, func() error {
+		regions = nil
+		return aggregatedListCall.Pages(ctx, func(aggregatedList *compute.SubnetworkAggregatedList) error {
+			for key, scopedList := range aggregatedList.Items {
+				for _, subnetwork := range scopedList.Subnetworks {
+					if subnetworkContains(subnetwork, networkIP) {
+						// Scopes are keyed as "regions/<region name>"
+						regions = append(regions, strings.TrimPrefix(key, "regions/"))
+					}
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list the subnetworks of project %s: %w", project, err)
+	}
+	return regions, nil
+}
+
+// checks if any of the subnetwork ranges contains the IP
+func subnetworkContains(subnetwork *compute.Subnetwork, ip net.IP) bool {
+	ranges := []string{subnetwork.IpCidrRange}
+	for _, secondary := range subnetwork.SecondaryIpRanges {
+		ranges = append(ranges, secondary.IpCidrRange)
+	}
+	for _, cidr := range ranges {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
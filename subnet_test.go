@@ -0,0 +1,129 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFindInstanceSubnetPrefilter(t *testing.T) {
+	defer func() { regionZones = map[string][]string{} }()
+	var mu sync.Mutex
+	var searched []string
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/aggregated/subnetworks"):
+			return jsonResponse(http.StatusOK, `{"items": {
+				"regions/us-central1": {"subnetworks": [{"name": "subnet-1", "ipCidrRange": "172.16.0.0/24"}]},
+				"regions/europe-west1": {"subnetworks": [{"name": "subnet-2", "ipCidrRange": "10.0.0.0/24", "secondaryIpRanges": [{"ipCidrRange": "10.1.0.0/16"}]}]}
+			}}`), nil
+		case strings.HasSuffix(req.URL.Path, "/regions/us-central1"):
+			return jsonResponse(http.StatusOK, `{"name": "us-central1", "zones": ["zones/us-central1-a", "zones/us-central1-b"]}`), nil
+		case strings.HasSuffix(req.URL.Path, "/regions/europe-west1"):
+			return jsonResponse(http.StatusOK, `{"name": "europe-west1", "zones": ["zones/europe-west1-b"]}`), nil
+		}
+		zone := strings.TrimSuffix(req.URL.Path[strings.Index(req.URL.Path, "/zones/")+len("/zones/"):], "/instances")
+		searched = append(searched, zone)
+		if zone != "us-central1-b" {
+			return jsonResponse(http.StatusOK, `{}`), nil
+		}
+		return jsonResponse(http.StatusOK, `{"items": [{"name": "instance-1", "networkInterfaces": [{"networkIP": "172.16.0.11"}]}]}`), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1"}, Zones: []string{"europe-west1-b", "us-central1-a", "us-central1-b"}, SubnetPrefilter: true, MaxRetries: 4, Concurrency: 1}
+	for networkIP, expected := range map[string][]string{
+		// The europe-west1 zone is out of the subnetwork range
+		"172.16.0.11": {"us-central1-a", "us-central1-b"},
+		"10.1.2.3":    {"europe-west1-b"},
+		// External IPs are on no subnetwork
+		"203.0.113.7": {"europe-west1-b", "us-central1-a", "us-central1-b"},
+	} {
+		searched = nil
+		instanceName, _, _, err := findInstance(context.Background(), computeService, cfg, networkIP)
+		if networkIP == "172.16.0.11" && (err != nil || instanceName != "instance-1") {
+			t.Fatalf("unexpected instance: %v %v", instanceName, err)
+		}
+		sort.Strings(searched)
+		if !reflect.DeepEqual(searched, expected) {
+			t.Fatalf("%v: '%v' != '%v'", networkIP, searched, expected)
+		}
+	}
+}
+
+func TestFindInstanceSubnetPrefilterForbidden(t *testing.T) {
+	defer func() { regionZones = map[string][]string{} }()
+	var mu sync.Mutex
+	var searched []string
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/projects/project-1/aggregated/subnetworks"):
+			return jsonResponse(http.StatusForbidden, `{"error": {"code": 403, "message": "Required 'compute.subnetworks.list' permission"}}`), nil
+		case strings.HasSuffix(req.URL.Path, "/aggregated/subnetworks"):
+			return jsonResponse(http.StatusOK, `{"items": {
+				"regions/us-central1": {"subnetworks": [{"name": "subnet-1", "ipCidrRange": "172.16.0.0/24"}]}
+			}}`), nil
+		case strings.HasSuffix(req.URL.Path, "/regions/us-central1"):
+			return jsonResponse(http.StatusOK, `{"name": "us-central1", "zones": ["zones/us-central1-a"]}`), nil
+		}
+		searched = append(searched, strings.TrimSuffix(req.URL.Path[strings.Index(req.URL.Path, "/projects/")+len("/projects/"):], "/instances"))
+		if !strings.HasSuffix(req.URL.Path, "/projects/project-2/zones/us-central1-a/instances") {
+			return jsonResponse(http.StatusOK, `{}`), nil
+		}
+		return jsonResponse(http.StatusOK, `{"items": [{"name": "instance-1", "networkInterfaces": [{"networkIP": "172.16.0.11"}]}]}`), nil
+	})
+
+	cfg := &Config{Projects: []string{"project-1", "project-2"}, Zones: []string{"europe-west1-b", "us-central1-a"}, SubnetPrefilter: true, MaxRetries: 4, Concurrency: 1}
+	instanceName, _, project, err := findInstance(context.Background(), computeService, cfg, "172.16.0.11")
+	if err != nil || instanceName != "instance-1" || project != "project-2" {
+		t.Fatalf("unexpected instance: %v %v %v", instanceName, project, err)
+	}
+	// All the zones of the project whose subnetworks can't be listed are searched
+	sort.Strings(searched)
+	expected := []string{"project-1/zones/europe-west1-b", "project-1/zones/us-central1-a", "project-2/zones/us-central1-a"}
+	if !reflect.DeepEqual(searched, expected) {
+		t.Fatalf("'%v' != '%v'", searched, expected)
+	}
+}
+
+func TestPrefilterScopes(t *testing.T) {
+	defer func() { regionZones = map[string][]string{} }()
+	var requested []string
+	computeService := newFakeComputeService(t, func(req *http.Request) (*http.Response, error) {
+		requested = append(requested, req.URL.Path)
+		if strings.HasSuffix(req.URL.Path, "/aggregated/subnetworks") {
+			return jsonResponse(http.StatusOK, `{"items": {
+				"regions/us-central1": {"subnetworks": [{"name": "subnet-1", "ipCidrRange": "172.16.0.0/24"}]}
+			}}`), nil
+		}
+		return jsonResponse(http.StatusOK, `{"name": "us-central1", "zones": ["zones/us-central1-a"]}`), nil
+	})
+	cfg := &Config{MaxRetries: 4}
+
+	// The projects searched in all their zones are kept without listing
+	// their subnetworks
+	aggregated := []searchScope{{project: "project-1"}, {project: "project-2"}}
+	scopes := prefilterScopes(context.Background(), computeService, cfg, aggregated, parseIP("172.16.0.11"))
+	if !reflect.DeepEqual(scopes, aggregated) || len(requested) != 0 {
+		t.Fatalf("unexpected scopes: %v requests: %v", scopes, requested)
+	}
+
+	mixed := []searchScope{{project: "project-1"}, {project: "project-2", zone: "europe-west1-b"}, {project: "project-2", zone: "us-central1-a"}}
+	scopes = prefilterScopes(context.Background(), computeService, cfg, mixed, parseIP("172.16.0.11"))
+	expected := []searchScope{{project: "project-1"}, {project: "project-2", zone: "us-central1-a"}}
+	if !reflect.DeepEqual(scopes, expected) {
+		t.Fatalf("'%v' != '%v'", scopes, expected)
+	}
+}
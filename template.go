@@ -0,0 +1,149 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// sourcesPlaceholder is the template argument replaced by all the scp
+// sources, each one its own argument
+const sourcesPlaceholder = "{{.Sources}}"
+
+// templateData are the values the GCLOUD_SSH_SSH_TEMPLATE and
+// GCLOUD_SSH_SCP_TEMPLATE placeholders are rendered with
+type templateData struct {
+	Project string
+	Zone    string
+	// Instance is the resolved instance name and User the login user,
+	// Destination is the ssh destination or scp target with the user@ prefix
+	Instance    string
+	User        string
+	Destination string
+	// Command is the remote command of ssh, empty without one
+	Command string
+	Port    string
+	Sources []string
+}
+
+// Gets the template values of a gcloud compute ssh run
+func sshTemplateData(cfg *Config, ar AnsibleRun) templateData {
+	user := loginUser(cfg, ar)
+	return templateData{
+		Project:     ar.Project,
+		Zone:        ar.Zone,
+		Instance:    ExtractIP(ar.Destination),
+		User:        user,
+		Destination: withUser(user, ar.Destination),
+		Command:     ar.remoteCommand(),
+		Port:        ar.Port,
+	}
+}
+
+// Gets the template values of a gcloud compute scp run, the remote sources
+// of a download have the user@ prefix like the uploaded destination
+func scpTemplateData(cfg *Config, ar AnsibleRun) templateData {
+	user := loginUser(cfg, ar)
+	data := templateData{
+		Project:     ar.Project,
+		Zone:        ar.Zone,
+		User:        user,
+		Destination: ar.Destination,
+		Port:        ar.Port,
+		Sources:     ar.Sources,
+	}
+	if !ar.Download {
+		data.Instance = ExtractIP(ar.Destination)
+		data.Destination = withUser(user, ar.Destination)
+		return data
+	}
+	data.Sources = make([]string, len(ar.Sources))
+	for i, source := range ar.Sources {
+		data.Sources[i] = withUser(user, source)
+	}
+	if len(ar.Sources) > 0 {
+		data.Instance = ExtractIP(ar.Sources[0])
+	}
+	return data
+}
+
+// Renders the gcloud arguments of a template. The template is split into
+// arguments like a shell command line before each one is rendered, so values
+// with spaces stay a single argument. The arguments rendered empty are
+// dropped, and {{.Sources}} is replaced by every source.
+func renderArgs(text string, data templateData) ([]string, error) {
+	tokens, err := splitTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{}
+	for _, token := range tokens {
+		if token == sourcesPlaceholder {
+			args = append(args, data.Sources...)
+			continue
+		}
+		tmpl, err := template.New("arg").Option("missingkey=error").Parse(token)
+		if err != nil {
+			return nil, err
+		}
+		var rendered bytes.Buffer
+		if err := tmpl.Execute(&rendered, data); err != nil {
+			return nil, err
+		}
+		if arg := rendered.String(); arg != "" {
+			args = append(args, arg)
+		}
+	}
+	return args, nil
+}
+
+// Splits a template into its arguments like a shell command line, the
+// spaces and quotes of its {{ }} actions separating nothing
+func splitTemplate(text string) ([]string, error) {
+	var actions []string
+	masked := ""
+	for {
+		start := strings.Index(text, "{{")
+		if start < 0 {
+			masked += text
+			break
+		}
+		end := strings.Index(text[start:], "}}")
+		if end < 0 {
+			return nil, fmt.Errorf("Unclosed action in %q", text[start:])
+		}
+		end += start + 2
+		masked += text[:start] + fmt.Sprintf("\x00%d\x00", len(actions))
+		actions = append(actions, text[start:end])
+		text = text[end:]
+	}
+	tokens, err := ParseCommandLine(masked)
+	if err != nil {
+		return nil, err
+	}
+	for i, token := range tokens {
+		for j, action := range actions {
+			token = strings.Replace(token, fmt.Sprintf("\x00%d\x00", j), action, 1)
+		}
+		tokens[i] = token
+	}
+	return tokens, nil
+}
+
+// Checks that the template of key renders, so a typo in a placeholder fails
+// when loading the config rather than at every run
+func validateTemplate(key, text string) error {
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	if _, err := renderArgs(text, templateData{}); err != nil {
+		return fmt.Errorf("Invalid %s: %w", key, err)
+	}
+	return nil
+}
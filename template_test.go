@@ -0,0 +1,83 @@
+// Copyright (c) 2020 RetailNext, Inc.
+// This software may be modified and distributed under the terms
+// of the MIT license. See the LICENSE file for details.
+// All rights reserved.
+
+package main
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRenderTemplates(t *testing.T) {
+	defer func(original Runner) { runner = original }(runner)
+	var runs [][]string
+	runner = func(name string, args []string, stderr io.Writer, timeout time.Duration) error {
+		runs = append(runs, args)
+		return nil
+	}
+	defer os.Unsetenv("GCLOUD_SSH_SSH_TEMPLATE")
+	defer os.Unsetenv("GCLOUD_SSH_SCP_TEMPLATE")
+	os.Setenv("GCLOUD_SSH_SSH_TEMPLATE", `beta compute ssh --project={{.Project}} --zone {{.Zone}} {{if .Port}}--ssh-flag=-p{{.Port}}{{end}} {{.Destination}} --command {{.Command}}`)
+	os.Setenv("GCLOUD_SSH_SCP_TEMPLATE", `compute scp --zone={{.Zone}} --project {{.Project}} {{.Sources}} {{.Destination}}`)
+	cfg := defaultConfig()
+	if err := cfg.applyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.GcloudPath = "true"
+
+	ssh := AnsibleRun{Command: "/bin/sh -c 'echo ~ && sleep 0'", Options: []string{"User=andy"}, Destination: "instance-1", Zone: "us-central1-a", Project: "project-1"}
+	if err := runGCloudSSH(&cfg, ssh); err != nil {
+		t.Fatal(err)
+	}
+	// The command stays a single argument
+	expected := []string{"beta", "compute", "ssh", "--project=project-1", "--zone", "us-central1-a", "andy@instance-1", "--command", "/bin/sh -c 'echo ~ && sleep 0'"}
+	if !reflect.DeepEqual(runs[0], expected) {
+		t.Fatalf("'%v' != '%v'", runs[0], expected)
+	}
+
+	scp := AnsibleRun{Options: []string{"User=andy"}, Sources: []string{"/tmp/file 1", "/tmp/file-2"}, Destination: "instance-1:/tmp/", Zone: "us-central1-a", Project: "project-1"}
+	if err := runGCloudSCP(&cfg, scp); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"compute", "scp", "--zone=us-central1-a", "--project", "project-1", "/tmp/file 1", "/tmp/file-2", "andy@instance-1:/tmp/"}
+	if !reflect.DeepEqual(runs[1], expected) {
+		t.Fatalf("'%v' != '%v'", runs[1], expected)
+	}
+
+	// The instance is the bare name of a destination with a user
+	os.Setenv("GCLOUD_SSH_SSH_TEMPLATE", `compute ssh {{.Instance}} --zone {{.Zone}} {{.Destination}}`)
+	os.Setenv("GCLOUD_SSH_SCP_TEMPLATE", `compute scp --zone {{.Zone}} {{.Sources}} {{.Destination}} --instance {{.Instance}}`)
+	cfg = defaultConfig()
+	if err := cfg.applyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.GcloudPath = "true"
+	ssh = AnsibleRun{Destination: "andy@instance-1", Zone: "us-central1-a", Project: "project-1"}
+	if err := runGCloudSSH(&cfg, ssh); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"compute", "ssh", "instance-1", "--zone", "us-central1-a", "andy@instance-1"}
+	if !reflect.DeepEqual(runs[2], expected) {
+		t.Fatalf("'%v' != '%v'", runs[2], expected)
+	}
+	scp = AnsibleRun{Sources: []string{"/tmp/file-1"}, Destination: "andy@instance-1:/tmp/", Zone: "us-central1-a", Project: "project-1"}
+	if err := runGCloudSCP(&cfg, scp); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"compute", "scp", "--zone", "us-central1-a", "/tmp/file-1", "andy@instance-1:/tmp/", "--instance", "instance-1"}
+	if !reflect.DeepEqual(runs[3], expected) {
+		t.Fatalf("'%v' != '%v'", runs[3], expected)
+	}
+
+	// Unknown placeholders fail when loading the config
+	os.Setenv("GCLOUD_SSH_SSH_TEMPLATE", `compute ssh {{.Instance}} --project {{.Projects}}`)
+	cfg = defaultConfig()
+	if err := cfg.applyEnv(); err == nil {
+		t.Fatal("invalid template error expected")
+	}
+}